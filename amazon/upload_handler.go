@@ -4,14 +4,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 	core "github.com/media_uploader/core"
 )
 
@@ -26,6 +29,33 @@ const (
 	awsURL             = "https://aaa780ca2d934ac0f129acd5a54e5c39.r2.cloudflarestorage.com/storage"
 )
 
+// ObjectKey returns the object key of an uploaded file
+func ObjectKey(filename string) string {
+	return "storage/" + filename
+}
+
+// PublicURL returns the public URL of an object
+func PublicURL(key string) string {
+	return "https://media.recram.com" + "/" + key
+}
+
+// ErrObjectExists is returned if the object already exists. Uploads never overwrite existing objects.
+var ErrObjectExists = errors.New("object already exists")
+
+// withoutOverwrite makes the write conditional, so it fails if the object already exists.
+func withoutOverwrite(o *s3.Options) {
+	o.APIOptions = append(o.APIOptions, smithyhttp.AddHeaderValue("If-None-Match", "*"))
+}
+
+// conditionalWriteError translates the failed precondition of a conditional write to ErrObjectExists.
+func conditionalWriteError(err error) error {
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusPreconditionFailed {
+		return ErrObjectExists
+	}
+	return err
+}
+
 // StreamUploadInit initializes the multipart upload process
 func StreamUploadInit(context *context.Context, mimeType, filename string) (*s3.Client, *s3.CreateMultipartUploadOutput, error) {
 	// Custom Endpoint Resolver for Cloudflare
@@ -49,7 +79,7 @@ func StreamUploadInit(context *context.Context, mimeType, filename string) (*s3.
 	svc := s3.NewFromConfig(cfg)
 
 	// Set up parameters for multipart upload initialization
-	path := "storage/" + filename
+	path := ObjectKey(filename)
 	input := &s3.CreateMultipartUploadInput{
 		Bucket:      aws.String(awsBucketName),
 		Key:         aws.String(path),
@@ -70,7 +100,6 @@ func StreamUploadInit(context *context.Context, mimeType, filename string) (*s3.
 func StreamUpload(context *context.Context, svc *s3.Client, resp *s3.CreateMultipartUploadOutput, buffer []byte, partNumber int32) (*s3.UploadPartOutput, error) {
 	var uploadResult *s3.UploadPartOutput
 	var err error
-	tries := 0
 
 	// Retry loop for uploading a part
 	for i := 0; i < maxRetries; i++ {
@@ -82,26 +111,20 @@ func StreamUpload(context *context.Context, svc *s3.Client, resp *s3.CreateMulti
 			UploadId:   resp.UploadId,
 		}
 		uploadResult, err = svc.UploadPart(*context, partInput)
-		if err != nil {
-			// Retry if unsuccessful
-			if tries < maxRetries {
-				tries++
-				continue
-			}
-
-			// Abort multipart upload in case of repeated failures
-			aboInput := &s3.AbortMultipartUploadInput{
-				Bucket:   resp.Bucket,
-				Key:      resp.Key,
-				UploadId: resp.UploadId,
-			}
-			_, aboErr := svc.AbortMultipartUpload(*context, aboInput)
-			if aboErr != nil {
-				core.LogError("Failed to abort multipart upload", aboErr)
-				return nil, aboErr
-			}
-			return nil, err
+		if err == nil {
+			break
 		}
+
+		// Don't retry if the upload has been cancelled
+		if (*context).Err() != nil {
+			break
+		}
+	}
+
+	// The caller aborts the multipart upload in case of repeated failures
+	if err != nil {
+		core.LogError(fmt.Sprintf("Failed to upload part number: %d", partNumber), err)
+		return nil, err
 	}
 
 	core.LogDebug(fmt.Sprintf("Uploaded part number: %d etag: %s", partNumber, *uploadResult.ETag))
@@ -121,10 +144,10 @@ func StreamDone(context *context.Context, svc *s3.Client, resp *s3.CreateMultipa
 	}
 
 	// Complete multipart upload
-	output, compErr := svc.CompleteMultipartUpload(*context, compInput)
+	output, compErr := svc.CompleteMultipartUpload(*context, compInput, withoutOverwrite)
 	if compErr != nil {
 		core.LogError("Failed to complete multipart upload", compErr)
-		return "", compErr
+		return "", conditionalWriteError(compErr)
 	}
 
 	// Print JSON output
@@ -137,12 +160,30 @@ func StreamDone(context *context.Context, svc *s3.Client, resp *s3.CreateMultipa
 	core.LogInfo(fmt.Sprintf("Completed multipart upload: %s", string(json)))
 
 	//PATCH:
-	outputPath := "https://media.recram.com" + "/" + *resp.Key
+	outputPath := PublicURL(*resp.Key)
 	//return *output.Location, nil
 
 	return outputPath, nil
 }
 
+// StreamAbort aborts the multipart upload process and discards the uploaded parts
+func StreamAbort(context *context.Context, svc *s3.Client, resp *s3.CreateMultipartUploadOutput) error {
+	aboInput := &s3.AbortMultipartUploadInput{
+		Bucket:   resp.Bucket,
+		Key:      resp.Key,
+		UploadId: resp.UploadId,
+	}
+
+	_, err := svc.AbortMultipartUpload(*context, aboInput)
+	if err != nil {
+		core.LogError("Failed to abort multipart upload", err)
+		return err
+	}
+
+	core.LogInfo(fmt.Sprintf("Aborted multipart upload: %s", *resp.Key))
+	return nil
+}
+
 // DirectUpload uploads an object directly without using multipart upload
 func DirectUpload(context *context.Context, mimeType, filename string, buffer []byte) (string, error) {
 	// Custom Endpoint Resolver for Cloudflare
@@ -166,7 +207,7 @@ func DirectUpload(context *context.Context, mimeType, filename string, buffer []
 	svc := s3.NewFromConfig(cfg)
 
 	// Set up parameters for direct object upload
-	path := "storage/" + filename
+	path := ObjectKey(filename)
 	input := &s3.PutObjectInput{
 		Bucket:      aws.String(awsBucketName),
 		Key:         aws.String(path),
@@ -175,12 +216,12 @@ func DirectUpload(context *context.Context, mimeType, filename string, buffer []
 	}
 
 	// Upload object directly
-	_, err = svc.PutObject(*context, input)
+	_, err = svc.PutObject(*context, input, withoutOverwrite)
 	if err != nil {
-		return "", err
+		return "", conditionalWriteError(err)
 	}
 
-	absPath := "https://media.recram.com" + "/" + path
+	absPath := PublicURL(path)
 
 	return absPath, nil
 }
@@ -0,0 +1,233 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/media_uploader/core"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Types of the audit events.
+const (
+	UploadStarted   = "upload.started"
+	UploadCompleted = "upload.completed"
+	UploadCancelled = "upload.cancelled"
+	UploadAborted   = "upload.aborted"
+	UploadDeleted   = "upload.deleted"
+)
+
+// hashField is the field of the hash, which is appended to every record of a chained log.
+const hashField = `,"hash":"`
+
+// Event is a record of the audit log.
+type Event struct {
+	Time time.Time `json:"time"`
+	// Seq is the sequence number of the record, so removed records are noticed.
+	Seq   uint64 `json:"seq"`
+	Event string `json:"event"`
+
+	MediaId   string `json:"mediaId,omitempty"`
+	ObjectKey string `json:"objectKey,omitempty"`
+	Endpoint  string `json:"endpoint,omitempty"`
+	// Subject is the client: the subject of its token or ticket, or "key:" and the id of its API key.
+	Subject  string `json:"subject,omitempty"`
+	Tenant   string `json:"tenant,omitempty"`
+	ClientIP string `json:"clientIp,omitempty"`
+
+	ContentType string `json:"contentType,omitempty"`
+	Size        int64  `json:"size"`
+	// Checksum is the hex encoded SHA-256 hash of the received data.
+	Checksum string `json:"checksum,omitempty"`
+	Location string `json:"location,omitempty"`
+
+	// PrevHash is the hash of the previous record of a chained log.
+	PrevHash string `json:"prevHash,omitempty"`
+}
+
+// Options are the settings of an audit log.
+type Options struct {
+	Path string
+	// Chain links every record to the previous one with a SHA-256 hash, so changes are evident.
+	Chain bool
+	// MaxSize is the size in megabytes after which the log is rotated.
+	MaxSize int
+	// MaxBackups is the number of rotated logs that are kept, zero to keep all.
+	MaxBackups int
+	// MaxAge is the number of days the rotated logs are kept, zero to keep them forever.
+	MaxAge int
+	// Compress compresses the rotated logs with gzip.
+	Compress bool
+}
+
+// Log is an append-only JSONL log of the upload lifecycle events, separate from the application log.
+// A nil Log doesn't record anything.
+type Log struct {
+	chain bool
+
+	mu       sync.Mutex
+	out      io.WriteCloser
+	seq      uint64
+	lastHash string
+}
+
+// Open opens the audit log. The sequence and the chain are continued from the last record of the file.
+func Open(opts Options) (*Log, error) {
+	seq, lastHash, partial, err := lastRecord(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	// The next record has to start on a line of its own.
+	if partial {
+		if err := endLine(opts.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	out := &lumberjack.Logger{
+		Filename:   opts.Path,
+		MaxSize:    opts.MaxSize,
+		MaxBackups: opts.MaxBackups,
+		MaxAge:     opts.MaxAge,
+		Compress:   opts.Compress,
+	}
+	return &Log{chain: opts.Chain, out: out, seq: seq, lastHash: lastHash}, nil
+}
+
+// Record appends an event to the log. The time, the sequence number and the hashes are set by the log.
+// Errors are logged, since the uploads must not fail because of the audit log.
+func (l *Log) Record(event Event) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.seq++
+	event.Time = time.Now().UTC()
+	event.Seq = l.seq
+	event.PrevHash = ""
+	if l.chain {
+		event.PrevHash = l.lastHash
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		core.LogError("Error (while encoding audit event)", err)
+		return
+	}
+
+	if l.chain {
+		hash := hashRecord(line)
+		line = append(append(append(line[:len(line)-1], hashField...), hash...), '"', '}')
+		l.lastHash = hash
+	}
+
+	if _, err := l.out.Write(append(line, '\n')); err != nil {
+		core.LogError("Error (while writing audit event)", err)
+	}
+}
+
+// Close closes the log.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.out.Close()
+}
+
+// hashRecord returns the hex encoded SHA-256 hash of a record without its hash field.
+// The record contains the hash of the previous one, which chains them.
+func hashRecord(record []byte) string {
+	sum := sha256.Sum256(record)
+	return hex.EncodeToString(sum[:])
+}
+
+// splitHash splits a chained record into the record without the hash field and the hash.
+func splitHash(line []byte) ([]byte, string, bool) {
+	i := bytes.LastIndex(line, []byte(hashField))
+	if i < 0 || !bytes.HasSuffix(line, []byte(`"}`)) {
+		return nil, "", false
+	}
+
+	record := append(append([]byte(nil), line[:i]...), '}')
+	return record, string(line[i+len(hashField) : len(line)-2]), true
+}
+
+// lastRecord returns the sequence number and the hash of the last record of a log, zero values if there is none.
+// The log is partial if its last line hasn't been ended, e.g. after a crash while a record was written.
+// A partial record is skipped.
+func lastRecord(path string) (seq uint64, hash string, partial bool, err error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, "", false, nil
+	}
+	if err != nil {
+		return 0, "", false, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, "", false, err
+	}
+
+	// A record is much smaller than the tail.
+	const tailSize = 64 * 1024
+	offset := max(stat.Size()-tailSize, 0)
+	tail := make([]byte, stat.Size()-offset)
+	if _, err := file.ReadAt(tail, offset); err != nil && !errors.Is(err, io.EOF) {
+		return 0, "", false, err
+	}
+	partial = len(tail) > 0 && !bytes.HasSuffix(tail, []byte("\n"))
+
+	lines := bytes.Split(bytes.TrimRight(tail, "\n"), []byte("\n"))
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := lines[i]
+		if len(line) == 0 {
+			return 0, "", partial, nil
+		}
+
+		var event struct {
+			Seq  uint64 `json:"seq"`
+			Hash string `json:"hash"`
+		}
+		err := json.Unmarshal(line, &event)
+		if err == nil {
+			return event.Seq, event.Hash, partial, nil
+		}
+
+		// Only the partial record may be invalid, the previous one is complete.
+		if !partial || i < len(lines)-1 {
+			return 0, "", false, fmt.Errorf("invalid last record of audit log %s: %w", path, err)
+		}
+		core.LogWarning(fmt.Sprintf("Skipped the partial last record of audit log %s: %v", path, err))
+	}
+	return 0, "", partial, nil
+}
+
+// endLine ends the partial last line of a log.
+func endLine(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write([]byte("\n")); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
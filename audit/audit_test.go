@@ -0,0 +1,104 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/media_uploader/core"
+)
+
+func TestMain(m *testing.M) {
+	// The logger writes to logs/app.log in the working directory.
+	dir, err := os.MkdirTemp("", "audit-test-*")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	core.InitializeLogger()
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// record opens the log, records the events and closes it.
+func record(t *testing.T, path string, events ...string) {
+	t.Helper()
+
+	log, err := Open(Options{Path: path, Chain: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range events {
+		log.Record(Event{Event: event})
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// appendData appends raw data to the log.
+func appendData(t *testing.T, path, data string) {
+	t.Helper()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenSkipsPartialRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	record(t, path, UploadStarted, UploadCompleted)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+	_, lastHash, ok := splitHash(lines[len(lines)-1])
+	if !ok {
+		t.Fatal("the last record has no hash")
+	}
+
+	// A crash while the third record was written.
+	appendData(t, path, `{"time":"2024-01-01T00:00:00Z","seq":3,"ev`)
+	record(t, path, UploadStarted)
+
+	data, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines = bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+	if len(lines) != 4 {
+		t.Fatalf("log has %d lines, want 4", len(lines))
+	}
+
+	var event Event
+	if err := json.Unmarshal(lines[3], &event); err != nil {
+		t.Fatalf("the record after the partial one is invalid: %v", err)
+	}
+	if event.Seq != 3 || event.PrevHash != lastHash {
+		t.Errorf("record = seq %d, prevHash %s, want seq 3 chained to %s", event.Seq, event.PrevHash, lastHash)
+	}
+}
+
+func TestOpenRejectsInvalidLastRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	record(t, path, UploadStarted)
+
+	// A complete line that isn't a record is not the result of a crash.
+	appendData(t, path, "not a record\n")
+	if _, err := Open(Options{Path: path}); err == nil {
+		t.Error("Open() with an invalid last record succeeded")
+	}
+}
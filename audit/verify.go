@@ -0,0 +1,71 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrTampered is returned when the chain of an audit log is broken.
+var ErrTampered = errors.New("audit log has been tampered with")
+
+// maxRecordSize is the maximum size of a record that is read by the verifier.
+const maxRecordSize = 1024 * 1024
+
+// Chain is the state of a chain that is verified across several files, e.g. the rotated logs.
+// The zero value starts a chain without knowing the records before.
+type Chain struct {
+	// Records is the number of verified records.
+	Records int
+	// Seq and Hash are the sequence number and the hash of the last verified record.
+	Seq  uint64
+	Hash string
+}
+
+// Verify verifies the records of a log against the chain and advances the chain. The first record of
+// a new chain is accepted with any previous hash, since the records before may have been rotated away.
+func (c *Chain) Verify(log io.Reader) error {
+	scanner := bufio.NewScanner(log)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := c.verifyRecord(scanner.Bytes()); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// verifyRecord verifies a record against the previous one.
+func (c *Chain) verifyRecord(line []byte) error {
+	record, hash, ok := splitHash(line)
+	if !ok {
+		return fmt.Errorf("%w: record has no hash", ErrTampered)
+	}
+
+	var event Event
+	if err := json.Unmarshal(record, &event); err != nil {
+		return fmt.Errorf("%w: invalid record: %v", ErrTampered, err)
+	}
+
+	if hashRecord(record) != hash {
+		return fmt.Errorf("%w: hash of record %d doesn't match", ErrTampered, event.Seq)
+	}
+
+	if c.Hash != "" && event.PrevHash != c.Hash {
+		return fmt.Errorf("%w: record %d doesn't follow the previous record", ErrTampered, event.Seq)
+	}
+	if c.Records > 0 && event.Seq != c.Seq+1 {
+		return fmt.Errorf("%w: record %d follows record %d", ErrTampered, event.Seq, c.Seq)
+	}
+
+	c.Records++
+	c.Seq = event.Seq
+	c.Hash = hash
+	return nil
+}
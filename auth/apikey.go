@@ -0,0 +1,331 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/media_uploader/core"
+)
+
+// ErrInvalidKey is returned when an API key is malformed, unknown, revoked or expired.
+var ErrInvalidKey = errors.New("invalid API key")
+
+// ErrKeyNotFound is returned when an API key doesn't exist.
+var ErrKeyNotFound = errors.New("API key not found")
+
+// APIKeyPrefix is the prefix of every API key, which tells them apart from JWTs.
+const APIKeyPrefix = "mu_"
+
+// Scopes of the API keys.
+const (
+	ScopeUpload = "upload"
+	ScopeRead   = "read"
+	ScopeDelete = "delete"
+	ScopeAdmin  = "admin"
+)
+
+// scopes are the known scopes.
+var scopes = []string{ScopeUpload, ScopeRead, ScopeDelete, ScopeAdmin}
+
+// APIKey is a long-lived credential of a service. Only the hash of its secret is stored.
+type APIKey struct {
+	Id     string   `json:"id"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Tenant restricts the key to a tenant, empty for none.
+	Tenant string `json:"tenant,omitempty"`
+	// Prefix restricts the media ids of the uploads to a prefix, empty for none.
+	Prefix string `json:"prefix,omitempty"`
+	// MaxSize is the maximum size of an upload in bytes, zero for unlimited.
+	MaxSize int64 `json:"maxSize,omitempty"`
+	// MaxConcurrentUploads overrides the cap of concurrent uploads for the key, zero for the default cap.
+	MaxConcurrentUploads int `json:"maxConcurrentUploads,omitempty"`
+
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	RotatedAt *time.Time `json:"rotatedAt,omitempty"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+
+	// Hash is the hex encoded SHA-256 hash of the key.
+	Hash string `json:"hash,omitempty"`
+	// PreviousHash is the hash of the key before the last rotation, which is accepted until PreviousExpiresAt.
+	PreviousHash      string     `json:"previousHash,omitempty"`
+	PreviousExpiresAt *time.Time `json:"previousExpiresAt,omitempty"`
+}
+
+// HasScope reports whether the key has a scope. The admin scope includes every other scope.
+func (k *APIKey) HasScope(scope string) bool {
+	return contains(k.Scopes, scope) || contains(k.Scopes, ScopeAdmin)
+}
+
+// active reports whether the key can be used.
+func (k *APIKey) active(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+// matches reports whether the hash is the current or, during the grace period of a rotation, the previous one.
+func (k *APIKey) matches(hash string, now time.Time) bool {
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(k.Hash)) == 1 {
+		return true
+	}
+	return k.PreviousHash != "" && k.PreviousExpiresAt != nil && now.Before(*k.PreviousExpiresAt) &&
+		subtle.ConstantTimeCompare([]byte(hash), []byte(k.PreviousHash)) == 1
+}
+
+// redacted returns a copy of the key without the hashes.
+func (k APIKey) redacted() APIKey {
+	k.Hash = ""
+	k.PreviousHash = ""
+	k.Scopes = append([]string(nil), k.Scopes...)
+	return k
+}
+
+// ValidateScopes checks that the scopes are known.
+func ValidateScopes(values []string) error {
+	if len(values) == 0 {
+		return errors.New("at least one scope is required")
+	}
+	for _, scope := range values {
+		if !contains(scopes, scope) {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	return nil
+}
+
+// IsAPIKey reports whether a bearer token is an API key.
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// KeyStore keeps the API keys in a JSON file, which is rewritten atomically after every change.
+type KeyStore struct {
+	path string
+
+	mu   sync.RWMutex
+	keys map[string]*APIKey
+}
+
+// OpenKeyStore opens the API keys of a file. A missing file is created with the first key.
+func OpenKeyStore(path string) (*KeyStore, error) {
+	s := &KeyStore{path: path, keys: make(map[string]*APIKey)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("invalid API key file %s: %w", path, err)
+	}
+	for _, k := range keys {
+		s.keys[k.Id] = k
+	}
+	return s, nil
+}
+
+// Empty reports whether the store has no keys.
+func (s *KeyStore) Empty() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.keys) == 0
+}
+
+// Create stores a new key with the settings of the template and returns it with its secret value.
+// The value is not stored and can't be recovered.
+func (s *KeyStore) Create(template APIKey) (APIKey, string, error) {
+	if err := ValidateScopes(template.Scopes); err != nil {
+		return APIKey{}, "", err
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	value, hash, err := newKeyValue(id)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+
+	key := template
+	key.Id = id
+	key.Scopes = append([]string(nil), template.Scopes...)
+	key.CreatedAt = time.Now().UTC()
+	key.RotatedAt, key.RevokedAt = nil, nil
+	key.Hash = hash
+	key.PreviousHash, key.PreviousExpiresAt = "", nil
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[id] = &key
+	if err := s.persist(); err != nil {
+		delete(s.keys, id)
+		return APIKey{}, "", err
+	}
+	return key.redacted(), value, nil
+}
+
+// List returns the keys without their hashes, sorted by creation time.
+func (s *KeyStore) List() []APIKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k.redacted())
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys
+}
+
+// Get returns a key without its hashes.
+func (s *KeyStore) Get(id string) (APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	k, ok := s.keys[id]
+	if !ok {
+		return APIKey{}, ErrKeyNotFound
+	}
+	return k.redacted(), nil
+}
+
+// Rotate replaces the secret value of a key. The previous value is accepted for the grace period.
+func (s *KeyStore) Rotate(id string, gracePeriod time.Duration) (APIKey, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[id]
+	if !ok {
+		return APIKey{}, "", ErrKeyNotFound
+	}
+	if !k.active(time.Now()) {
+		return APIKey{}, "", fmt.Errorf("%w: key is revoked or expired", ErrInvalidKey)
+	}
+
+	value, hash, err := newKeyValue(id)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+
+	previous := *k
+	now := time.Now().UTC()
+	k.RotatedAt = &now
+	k.PreviousHash, k.PreviousExpiresAt = "", nil
+	if gracePeriod > 0 {
+		expiresAt := now.Add(gracePeriod)
+		k.PreviousHash, k.PreviousExpiresAt = k.Hash, &expiresAt
+	}
+	k.Hash = hash
+
+	if err := s.persist(); err != nil {
+		*k = previous
+		return APIKey{}, "", err
+	}
+	return k.redacted(), value, nil
+}
+
+// Revoke revokes a key. Revoked keys are kept, so they show up in the list.
+func (s *KeyStore) Revoke(id string) (APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[id]
+	if !ok {
+		return APIKey{}, ErrKeyNotFound
+	}
+	if k.RevokedAt != nil {
+		return k.redacted(), nil
+	}
+
+	now := time.Now().UTC()
+	k.RevokedAt = &now
+	if err := s.persist(); err != nil {
+		k.RevokedAt = nil
+		return APIKey{}, err
+	}
+	return k.redacted(), nil
+}
+
+// Verify checks an API key and returns the claims of the client: the subject is "key:" and the key id,
+// and the tenant is the tenant of the key.
+func (s *KeyStore) Verify(value string) (*Claims, error) {
+	id, _, ok := strings.Cut(strings.TrimPrefix(value, APIKeyPrefix), "_")
+	if !IsAPIKey(value) || !ok {
+		return nil, fmt.Errorf("%w: malformed key", ErrInvalidKey)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	k, ok := s.keys[id]
+	now := time.Now()
+	if !ok || !k.matches(hashKey(value), now) {
+		return nil, ErrInvalidKey
+	}
+	if !k.active(now) {
+		return nil, fmt.Errorf("%w: key is revoked or expired", ErrInvalidKey)
+	}
+
+	key := k.redacted()
+	return &Claims{Subject: "key:" + k.Id, Tenant: k.Tenant, Key: &key}, nil
+}
+
+// persist writes the keys to a temporary file and renames it, so the file is never half-written.
+// The caller must hold the mutex.
+func (s *KeyStore) persist() error {
+	keys := make([]*APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return core.WriteFileAtomic(s.path, data)
+}
+
+// newKeyValue generates the secret value of a key and its hash.
+func newKeyValue(id string) (string, string, error) {
+	var secret [32]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return "", "", err
+	}
+
+	value := APIKeyPrefix + id + "_" + base64.RawURLEncoding.EncodeToString(secret[:])
+	return value, hashKey(value), nil
+}
+
+// hashKey returns the hex encoded SHA-256 hash of a key. The keys are random, so a fast hash is sufficient.
+func hashKey(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomHex returns n random bytes in hex.
+func randomHex(n int) (string, error) {
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
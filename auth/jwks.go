@@ -0,0 +1,251 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/media_uploader/core"
+)
+
+// jwksRefreshInterval is the minimum time between two reloads of a JWKS for an unknown key id.
+const jwksRefreshInterval = time.Minute
+
+// key is a verification key.
+type key struct {
+	id string
+	// algorithm is the algorithm the key is restricted to, empty for the algorithms of its type.
+	algorithm string
+	// key is a []byte for HMAC, a *rsa.PublicKey or an *ecdsa.PublicKey.
+	key any
+}
+
+// supports reports whether the key can verify signatures of the algorithm.
+func (k key) supports(algorithm string) bool {
+	if k.algorithm != "" && k.algorithm != algorithm {
+		return false
+	}
+
+	switch k.key.(type) {
+	case []byte:
+		return algorithm == HS256
+	case *rsa.PublicKey:
+		return algorithm == RS256
+	case *ecdsa.PublicKey:
+		return algorithm == ES256
+	}
+	return false
+}
+
+// KeySet holds the verification keys of the tokens. Keys loaded from a JWKS source are reloaded
+// when a token refers to an unknown key id, so rotated keys are picked up.
+type KeySet struct {
+	mu     sync.RWMutex
+	keys   []key
+	static []key
+	// source is the path or URL of the JWKS, empty if there is none.
+	source   string
+	loadedAt time.Time
+}
+
+// NewKeySet creates an empty key set.
+func NewKeySet() *KeySet {
+	return &KeySet{}
+}
+
+// AddSecret adds a shared secret for HS256.
+func (s *KeySet) AddSecret(secret []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.static = append(s.static, key{algorithm: HS256, key: secret})
+	s.keys = append(s.keys, key{algorithm: HS256, key: secret})
+}
+
+// LoadJWKS loads the keys of a JWK Set from a file or an http(s) URL.
+func (s *KeySet) LoadJWKS(source string) error {
+	keys, err := fetchJWKS(source)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.source = source
+	s.loadedAt = time.Now()
+	s.keys = append(append([]key(nil), s.static...), keys...)
+	return nil
+}
+
+// lookup returns the keys that can verify a token with the key id and the algorithm.
+func (s *KeySet) lookup(id, algorithm string) []key {
+	keys := s.find(id, algorithm)
+	if len(keys) > 0 || id == "" || !s.stale() {
+		return keys
+	}
+
+	// The key may have been rotated.
+	if err := s.LoadJWKS(s.source); err != nil {
+		core.LogError("Error (while reloading JWKS)", err)
+		return nil
+	}
+	return s.find(id, algorithm)
+}
+
+// find returns the matching keys. A token without key id can be verified by every key of its algorithm.
+func (s *KeySet) find(id, algorithm string) []key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var keys []key
+	for _, k := range s.keys {
+		if (id == "" || k.id == "" || k.id == id) && k.supports(algorithm) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// stale reports whether the JWKS can be reloaded.
+func (s *KeySet) stale() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.source != "" && time.Since(s.loadedAt) > jwksRefreshInterval
+}
+
+// jwk is a JSON Web Key.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// Symmetric
+	K string `json:"k"`
+}
+
+// fetchJWKS reads and parses a JWK Set.
+func fetchJWKS(source string) ([]key, error) {
+	var data []byte
+	var err error
+
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		data, err = download(source)
+	} else {
+		data, err = os.ReadFile(source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load JWKS %s: %w", source, err)
+	}
+
+	return parseJWKS(data)
+}
+
+// download downloads a JWK Set.
+func download(url string) ([]byte, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+}
+
+// parseJWKS parses the verification keys of a JWK Set. Keys that are not used for signatures are skipped.
+func parseJWKS(data []byte) ([]key, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	var keys []key
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		parsed, err := k.parse()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", k.Kid, err)
+		}
+		keys = append(keys, key{id: k.Kid, algorithm: k.Alg, key: parsed})
+	}
+	return keys, nil
+}
+
+// parse returns the key material of the JWK.
+func (k jwk) parse() (any, error) {
+	switch k.Kty {
+	case "oct":
+		return decodeBase64(k.K)
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !publicKey.Curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on the curve")
+		}
+		return publicKey, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// decodeBase64 decodes a base64url value without padding.
+func decodeBase64(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+// decodeBigInt decodes a base64url encoded big-endian integer.
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := decodeBase64(value)
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("invalid integer")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,244 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is returned when a token is malformed, its signature is invalid or its claims are not accepted.
+var ErrInvalidToken = errors.New("invalid token")
+
+// ErrExpiredToken is returned when a token has expired or is not valid yet.
+var ErrExpiredToken = errors.New("token expired")
+
+// Supported signing algorithms.
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+// Claims are the verified claims of a token.
+type Claims struct {
+	Subject   string
+	Issuer    string
+	Audience  []string
+	ExpiresAt time.Time
+	// Tenant is the tenant of the client, taken from the tenant claim of the verifier.
+	Tenant string
+	// Values are all claims of the token.
+	Values map[string]any
+	// Key is the API key the claims are derived from, nil for tokens.
+	Key *APIKey
+}
+
+// HasScope reports whether the client may use a scope. Tokens of end users are not restricted by scopes,
+// and nil claims (authentication is disabled) have every scope.
+func (c *Claims) HasScope(scope string) bool {
+	return c == nil || c.Key == nil || c.Key.HasScope(scope)
+}
+
+// MaxConcurrentUploads returns the cap of concurrent uploads of an API key, zero for the default cap.
+func (c *Claims) MaxConcurrentUploads() int {
+	if c == nil || c.Key == nil {
+		return 0
+	}
+	return c.Key.MaxConcurrentUploads
+}
+
+// Verifier verifies JWTs signed with HS256, RS256 or ES256.
+type Verifier struct {
+	Keys *KeySet
+	// Issuer is the required "iss" claim, empty to accept any issuer.
+	Issuer string
+	// Audience is the required value of the "aud" claim, empty to accept any audience.
+	Audience string
+	// TenantClaim is the name of the claim that holds the tenant of the client.
+	TenantClaim string
+	// Leeway is the allowed clock skew for the "exp" and "nbf" claims.
+	Leeway time.Duration
+}
+
+// header is the JOSE header of a token.
+type header struct {
+	Algorithm string `json:"alg"`
+	KeyId     string `json:"kid"`
+}
+
+// Verify verifies the signature and the claims of a token in compact serialization.
+// Tokens without an "exp" claim are rejected.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, fmt.Errorf("%w: malformed header", ErrInvalidToken)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrInvalidToken)
+	}
+
+	keys := v.Keys.lookup(h.KeyId, h.Algorithm)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no key for algorithm %q and key id %q", ErrInvalidToken, h.Algorithm, h.KeyId)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range keys {
+		if verifySignature(h.Algorithm, key.key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: invalid signature", ErrInvalidToken)
+	}
+
+	var values map[string]any
+	if err := decodeSegment(parts[1], &values); err != nil {
+		return nil, fmt.Errorf("%w: malformed claims", ErrInvalidToken)
+	}
+
+	return v.validate(values)
+}
+
+// validate checks the registered claims and returns the claims of the token.
+func (v *Verifier) validate(values map[string]any) (*Claims, error) {
+	now := time.Now()
+	claims := &Claims{Values: values}
+
+	exp, ok := numericDate(values["exp"])
+	if !ok {
+		return nil, fmt.Errorf("%w: exp claim is required", ErrInvalidToken)
+	}
+	if now.After(exp.Add(v.Leeway)) {
+		return nil, ErrExpiredToken
+	}
+	claims.ExpiresAt = exp
+
+	if _, present := values["nbf"]; present {
+		nbf, ok := numericDate(values["nbf"])
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid nbf claim", ErrInvalidToken)
+		}
+		if now.Add(v.Leeway).Before(nbf) {
+			return nil, ErrExpiredToken
+		}
+	}
+
+	claims.Subject, _ = values["sub"].(string)
+	claims.Issuer, _ = values["iss"].(string)
+	claims.Audience = audience(values["aud"])
+
+	if v.Issuer != "" && claims.Issuer != v.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, claims.Issuer)
+	}
+	if v.Audience != "" && !contains(claims.Audience, v.Audience) {
+		return nil, fmt.Errorf("%w: token is not issued for %q", ErrInvalidToken, v.Audience)
+	}
+
+	if v.TenantClaim != "" {
+		claims.Tenant, _ = values[v.TenantClaim].(string)
+	}
+
+	return claims, nil
+}
+
+// verifySignature verifies the signature of the signed data with the key of the algorithm.
+func verifySignature(algorithm string, key any, signed, signature []byte) bool {
+	digest := sha256.Sum256(signed)
+
+	switch algorithm {
+	case HS256:
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case RS256:
+		publicKey, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) == nil
+	case ES256:
+		publicKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return false
+		}
+		// The signature is the concatenation of R and S, not ASN.1.
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(publicKey, digest[:], r, s)
+	}
+	return false
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token.
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// numericDate converts a NumericDate claim to a time.
+func numericDate(value any) (time.Time, bool) {
+	number, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second))), true
+}
+
+// audience returns the values of the "aud" claim, which is either a string or an array of strings.
+func audience(value any) []string {
+	switch aud := value.(type) {
+	case string:
+		return []string{aud}
+	case []any:
+		var values []string
+		for _, item := range aud {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// contains reports whether the list contains the value.
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
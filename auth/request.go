@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrMissingToken is returned when a request doesn't carry a token.
+var ErrMissingToken = errors.New("token is missing")
+
+// Subprotocol is the WebSocket subprotocol that is selected for authenticated connections.
+// Browsers can't set the Authorization header of a WebSocket handshake, so they pass the token
+// as a second subprotocol with the SubprotocolPrefix: new WebSocket(url, ["media-uploader", "bearer." + token]).
+const Subprotocol = "media-uploader"
+
+// SubprotocolPrefix is the prefix of the subprotocol that carries the token.
+const SubprotocolPrefix = "bearer."
+
+// TokenQueryParameter is the query parameter that carries the token.
+const TokenQueryParameter = "access_token"
+
+// TokenFromRequest returns the bearer token of a request. The token is taken from the Authorization header,
+// the WebSocket subprotocols or the query, in that order.
+func TokenFromRequest(r *http.Request) (string, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, ok := strings.Cut(header, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return "", ErrInvalidToken
+		}
+		return strings.TrimSpace(token), nil
+	}
+
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			if token, ok := strings.CutPrefix(strings.TrimSpace(protocol), SubprotocolPrefix); ok && token != "" {
+				return token, nil
+			}
+		}
+	}
+
+	if token := r.URL.Query().Get(TokenQueryParameter); token != "" {
+		return token, nil
+	}
+
+	return "", ErrMissingToken
+}
+
+// claimsKey is the context key of the claims.
+type claimsKey struct{}
+
+// NewContext returns a context that carries the claims of the client.
+func NewContext(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// FromContext returns the claims of the client, nil if the context doesn't carry any.
+func FromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(claimsKey{}).(*Claims)
+	return claims
+}
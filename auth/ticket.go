@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidTicket is returned when an upload ticket is malformed, its signature is invalid or it has expired.
+var ErrInvalidTicket = errors.New("invalid ticket")
+
+// ErrTicketUsed is returned when an upload ticket has already been redeemed.
+var ErrTicketUsed = errors.New("ticket has already been used")
+
+// Ticket authorizes a single upload. The zero values of the restrictions allow everything.
+type Ticket struct {
+	// AllowedTypes are the allowed media types. Wildcards like "video/*" are supported.
+	AllowedTypes []string `json:"types,omitempty"`
+	// MaxSize is the maximum size of the upload in bytes.
+	MaxSize int64 `json:"maxSize,omitempty"`
+	// MediaId is the media id of the upload, so the object key is fixed.
+	MediaId string `json:"mediaId,omitempty"`
+	// Prefix is prepended to the generated media id of the upload.
+	Prefix string `json:"prefix,omitempty"`
+	// Subject and Tenant are the client the ticket has been issued for.
+	Subject string `json:"sub,omitempty"`
+	Tenant  string `json:"tenant,omitempty"`
+	// ExpiresAt is the expiry of the ticket in Unix seconds.
+	ExpiresAt int64 `json:"exp"`
+	// Nonce makes the ticket unique, so it can be redeemed only once.
+	Nonce string `json:"nonce"`
+}
+
+// Tickets issues and redeems HMAC-signed upload tickets.
+//
+// A ticket is the base64url encoded JSON of the Ticket and its base64url encoded HMAC-SHA256 signature,
+// separated by a dot. Redeemed nonces are kept in memory until the ticket expires.
+type Tickets struct {
+	secret []byte
+	used   *ReplayCache
+}
+
+// NewTickets creates a ticket issuer with the secret of the signatures.
+func NewTickets(secret []byte) *Tickets {
+	return &Tickets{secret: secret, used: NewReplayCache()}
+}
+
+// Issue signs a ticket. A random nonce is generated if the ticket doesn't have one.
+func (t *Tickets) Issue(ticket Ticket) (string, error) {
+	if ticket.ExpiresAt == 0 {
+		return "", fmt.Errorf("%w: expiry is required", ErrInvalidTicket)
+	}
+
+	if ticket.Nonce == "" {
+		var nonce [16]byte
+		if _, err := rand.Read(nonce[:]); err != nil {
+			return "", err
+		}
+		ticket.Nonce = hex.EncodeToString(nonce[:])
+	}
+
+	payload, err := json.Marshal(ticket)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(t.sign(encoded)), nil
+}
+
+// Redeem marks a verified ticket as used. ErrTicketUsed is returned if it has already been redeemed.
+func (t *Tickets) Redeem(ticket *Ticket) error {
+	if !t.used.Use(ticket.Nonce, time.Unix(ticket.ExpiresAt, 0)) {
+		return ErrTicketUsed
+	}
+	return nil
+}
+
+// Verify checks the signature and the expiry of a ticket. The ticket is not redeemed, see Redeem.
+func (t *Tickets) Verify(value string) (*Ticket, error) {
+	encoded, encodedSignature, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, fmt.Errorf("%w: malformed ticket", ErrInvalidTicket)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil || !hmac.Equal(signature, t.sign(encoded)) {
+		return nil, fmt.Errorf("%w: invalid signature", ErrInvalidTicket)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed ticket", ErrInvalidTicket)
+	}
+
+	var ticket Ticket
+	if err := json.Unmarshal(payload, &ticket); err != nil {
+		return nil, fmt.Errorf("%w: malformed ticket", ErrInvalidTicket)
+	}
+
+	if ticket.Nonce == "" {
+		return nil, fmt.Errorf("%w: nonce is missing", ErrInvalidTicket)
+	}
+	if time.Now().Unix() >= ticket.ExpiresAt {
+		return nil, fmt.Errorf("%w: ticket expired", ErrInvalidTicket)
+	}
+
+	return &ticket, nil
+}
+
+// sign returns the signature of the encoded payload.
+func (t *Tickets) sign(encoded string) []byte {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// replayPurgeInterval is the minimum time between two purges of the expired nonces.
+const replayPurgeInterval = time.Minute
+
+// ReplayCache remembers used nonces until they expire.
+type ReplayCache struct {
+	mu       sync.Mutex
+	nonces   map[string]time.Time
+	purgedAt time.Time
+}
+
+// NewReplayCache creates an empty replay cache.
+func NewReplayCache() *ReplayCache {
+	return &ReplayCache{nonces: make(map[string]time.Time)}
+}
+
+// Use marks the nonce as used until it expires. It returns false if the nonce has already been used.
+func (c *ReplayCache) Use(nonce string, expiresAt time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.purgedAt) > replayPurgeInterval {
+		for n, expiry := range c.nonces {
+			if now.After(expiry) {
+				delete(c.nonces, n)
+			}
+		}
+		c.purgedAt = now
+	}
+
+	if _, ok := c.nonces[nonce]; ok {
+		return false
+	}
+	c.nonces[nonce] = expiresAt
+	return true
+}
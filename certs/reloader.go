@@ -0,0 +1,128 @@
+package certs
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/media_uploader/core"
+)
+
+// Reloader serves a TLS certificate from a certificate and a key file and reloads it when the files change,
+// so renewed certificates are picked up without a restart.
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	// modTimes are the modification times of the certificate and the key file of the loaded certificate.
+	modTimes [2]time.Time
+	// failedModTimes are the modification times of the files that failed to load last, so an invalid pair
+	// is only reloaded once it changes again.
+	failedModTimes [2]time.Time
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// NewReloader loads the certificate of the files.
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile, stop: make(chan struct{})}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate of the files. The previous certificate is kept if they are invalid.
+func (r *Reloader) Reload() error {
+	modTimes, err := r.stat()
+	if err != nil {
+		return err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		r.mu.Lock()
+		r.failedModTimes = modTimes
+		r.mu.Unlock()
+		return fmt.Errorf("failed to load certificate %s: %w", r.certFile, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.certificate = &certificate
+	r.modTimes = modTimes
+	return nil
+}
+
+// GetCertificate returns the current certificate. It's meant for tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.certificate, nil
+}
+
+// TLSConfig returns a server config that serves the current certificate.
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+}
+
+// Watch checks the files for changes every interval and reloads the certificate until Stop is called.
+func (r *Reloader) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			if err := r.Reload(); err != nil {
+				core.LogError("Error (while reloading certificate)", err)
+				continue
+			}
+			core.LogInfo(fmt.Sprintf("Reloaded certificate %s", r.certFile))
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Stop stops watching the files.
+func (r *Reloader) Stop() {
+	r.once.Do(func() { close(r.stop) })
+}
+
+// changed reports whether a file has been modified since the certificate was loaded, or since it failed to load.
+func (r *Reloader) changed() bool {
+	modTimes, err := r.stat()
+	if err != nil {
+		// The files may be replaced right now, they are checked again with the next tick.
+		return false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return modTimes != r.modTimes && modTimes != r.failedModTimes
+}
+
+// stat returns the modification times of the certificate and the key file.
+func (r *Reloader) stat() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, file := range []string{r.certFile, r.keyFile} {
+		stat, err := os.Stat(file)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = stat.ModTime()
+	}
+	return modTimes, nil
+}
@@ -0,0 +1,273 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/media_uploader/core"
+)
+
+func TestMain(m *testing.M) {
+	// The logger writes to logs/app.log in the working directory.
+	dir, err := os.MkdirTemp("", "certs-test-*")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	core.InitializeLogger()
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testPair is a self-signed certificate for localhost in PEM.
+type testPair struct {
+	serial *big.Int
+	cert   []byte
+	key    []byte
+}
+
+var nextSerial int64
+
+// generatePair generates a self-signed certificate with a new serial number.
+func generatePair(t *testing.T) testPair {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nextSerial++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(nextSerial),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testPair{
+		serial: template.SerialNumber,
+		cert:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		key:    pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// modTime is the modification time of the written files, which is advanced with every write,
+// since the resolution of the file system may hide quick rewrites.
+var modTime = time.Now().Add(-time.Hour)
+
+// writeFile writes a certificate or key file with a new modification time.
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	modTime = modTime.Add(time.Second)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writePair writes the certificate and the key file of a pair.
+func writePair(t *testing.T, certFile, keyFile string, pair testPair) {
+	t.Helper()
+	writeFile(t, certFile, pair.cert)
+	writeFile(t, keyFile, pair.key)
+}
+
+// tempFiles returns the paths of a certificate and a key file in a temporary directory.
+func tempFiles(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	return filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+}
+
+// servedSerial returns the serial number of the certificate that the reloader serves.
+func servedSerial(t *testing.T, r *Reloader) *big.Int {
+	t.Helper()
+
+	certificate, err := r.GetCertificate(&tls.ClientHelloInfo{ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber
+}
+
+// serveTLS accepts TLS connections with the config of the reloader and completes their handshakes.
+func serveTLS(t *testing.T, r *Reloader) string {
+	t.Helper()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", r.TLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// handshake connects to the server and verifies that it presents the certificate of the pair.
+func handshake(t *testing.T, addr string, pair testPair) {
+	t.Helper()
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pair.cert) {
+		t.Fatal("invalid certificate")
+	}
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "localhost", RootCAs: roots})
+	if err != nil {
+		t.Fatalf("handshake with certificate %s: %v", pair.serial, err)
+	}
+	defer conn.Close()
+
+	if serial := conn.ConnectionState().PeerCertificates[0].SerialNumber; serial.Cmp(pair.serial) != 0 {
+		t.Errorf("server presented certificate %s, want %s", serial, pair.serial)
+	}
+}
+
+// awaitSerial waits until the reloader serves the certificate with the serial number.
+func awaitSerial(t *testing.T, r *Reloader, serial *big.Int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for servedSerial(t, r).Cmp(serial) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("reloader serves certificate %s, want %s", servedSerial(t, r), serial)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloaderServesRenewedCertificate(t *testing.T) {
+	certFile, keyFile := tempFiles(t)
+	old, renewed := generatePair(t), generatePair(t)
+	writePair(t, certFile, keyFile, old)
+
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.Watch(10 * time.Millisecond)
+	defer r.Stop()
+
+	addr := serveTLS(t, r)
+	handshake(t, addr, old)
+
+	writePair(t, certFile, keyFile, renewed)
+	awaitSerial(t, r, renewed.serial)
+	handshake(t, addr, renewed)
+}
+
+func TestReloaderKeepsCertificateOfInvalidPair(t *testing.T) {
+	certFile, keyFile := tempFiles(t)
+	old, renewed := generatePair(t), generatePair(t)
+	writePair(t, certFile, keyFile, old)
+
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name string
+		cert []byte
+		key  []byte
+	}{
+		// The certificate has been replaced, but the key not yet.
+		{"half-written pair", renewed.cert, old.key},
+		{"truncated certificate", renewed.cert[:len(renewed.cert)/2], renewed.key},
+		{"invalid key", renewed.cert, []byte("not a key")},
+	}
+	for _, step := range steps {
+		writeFile(t, certFile, step.cert)
+		writeFile(t, keyFile, step.key)
+
+		if !r.changed() {
+			t.Errorf("%s: changed() = false, want true", step.name)
+		}
+		if err := r.Reload(); err == nil {
+			t.Errorf("%s: Reload() succeeded", step.name)
+		}
+		// The invalid pair isn't loaded again until it changes.
+		if r.changed() {
+			t.Errorf("%s: changed() = true after the failed reload", step.name)
+		}
+		if serial := servedSerial(t, r); serial.Cmp(old.serial) != 0 {
+			t.Errorf("%s: reloader serves certificate %s, want %s", step.name, serial, old.serial)
+		}
+	}
+
+	// The watcher keeps retrying until the pair is complete.
+	go r.Watch(10 * time.Millisecond)
+	defer r.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+	if serial := servedSerial(t, r); serial.Cmp(old.serial) != 0 {
+		t.Errorf("reloader serves certificate %s of an invalid pair, want %s", serial, old.serial)
+	}
+
+	writeFile(t, keyFile, renewed.key)
+	awaitSerial(t, r, renewed.serial)
+	if r.changed() {
+		t.Error("changed() = true after the reload")
+	}
+}
+
+func TestNewReloaderInvalidPair(t *testing.T) {
+	certFile, keyFile := tempFiles(t)
+
+	if _, err := NewReloader(certFile, keyFile); err == nil {
+		t.Error("NewReloader() without files succeeded")
+	}
+
+	pair, other := generatePair(t), generatePair(t)
+	writePair(t, certFile, keyFile, pair)
+	writeFile(t, keyFile, other.key)
+	if _, err := NewReloader(certFile, keyFile); err == nil {
+		t.Error("NewReloader() with a mismatched key succeeded")
+	}
+}
@@ -0,0 +1,63 @@
+// Command auditverify verifies the hash chain of audit logs.
+//
+//	auditverify [-prevHash <hash>] <log>...
+//
+// The logs are verified as one chain in the given order, so rotated logs have to be passed oldest first.
+// Compressed (.gz) logs are supported.
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/media_uploader/audit"
+)
+
+var prevHash = flag.String("prevHash", "", "Hash of the record before the first one, e.g. the last hash of an earlier verification")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: auditverify [-prevHash <hash>] <log>...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	chain := audit.Chain{Hash: *prevHash}
+	for _, path := range flag.Args() {
+		if err := verifyFile(&chain, path); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			os.Exit(1)
+		}
+	}
+
+	fmt.Printf("OK: %d records, last record %d with hash %s\n", chain.Records, chain.Seq, chain.Hash)
+}
+
+func verifyFile(chain *audit.Chain, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var log io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		reader, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		log = reader
+	}
+
+	return chain.Verify(log)
+}
@@ -0,0 +1,198 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrMemoryLimit is returned when a task is rejected because the memory usage exceeds the limit.
+var ErrMemoryLimit = errors.New("memory limit exceeded")
+
+// MemoryStats is the memory usage of the process in bytes.
+type MemoryStats struct {
+	// Heap is the memory occupied by heap objects.
+	Heap uint64
+	// Total is the memory mapped by the Go runtime that has not been released to the OS,
+	// which approximates the resident memory of the process.
+	Total uint64
+}
+
+// MemorySource reports the memory usage of the process, so that it can be faked in tests.
+type MemorySource interface {
+	MemoryStats() MemoryStats
+}
+
+// runtimeMetrics are the metrics read by RuntimeMemory.
+var runtimeMetrics = []string{
+	"/memory/classes/heap/objects:bytes",
+	"/memory/classes/total:bytes",
+	"/memory/classes/heap/released:bytes",
+}
+
+// RuntimeMemory reads the memory usage from the runtime/metrics of the Go runtime,
+// which unlike runtime.ReadMemStats doesn't stop the world.
+type RuntimeMemory struct{}
+
+// MemoryStats returns the current memory usage.
+func (RuntimeMemory) MemoryStats() MemoryStats {
+	samples := make([]metrics.Sample, len(runtimeMetrics))
+	for i, name := range runtimeMetrics {
+		samples[i].Name = name
+	}
+	metrics.Read(samples)
+
+	value := func(i int) uint64 {
+		if samples[i].Value.Kind() != metrics.KindUint64 {
+			return 0
+		}
+		return samples[i].Value.Uint64()
+	}
+
+	total, released := value(1), value(2)
+	return MemoryStats{Heap: value(0), Total: total - min(released, total)}
+}
+
+// procCgroup and cgroupRoot are the cgroups of the process and the mount point of the cgroup hierarchies,
+// which are replaced in tests.
+var (
+	procCgroup = "/proc/self/cgroup"
+	cgroupRoot = "/sys/fs/cgroup"
+)
+
+// cgroupUnlimited is the smallest limit that is treated as unlimited. cgroup v1 reports no limit as
+// the largest page-aligned int64.
+const cgroupUnlimited = 1 << 62
+
+// CgroupMemoryLimit returns the memory limit of the cgroup (v2 or v1) of the process.
+// The second return value is false if there is no limit or it can't be read.
+func CgroupMemoryLimit() (uint64, bool) {
+	cgroups, err := readCgroups(procCgroup)
+	if err != nil {
+		return 0, false
+	}
+
+	// cgroup v2 has a unified hierarchy with the controllers in its root.
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err == nil {
+		return readCgroupLimit(cgroupRoot, cgroups[""], "memory.max")
+	}
+	return readCgroupLimit(filepath.Join(cgroupRoot, "memory"), cgroups["memory"], "memory.limit_in_bytes")
+}
+
+// readCgroups returns the cgroup paths of the process by controller, the unified hierarchy of
+// cgroup v2 has the empty controller.
+func readCgroups(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	cgroups := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// A line is "hierarchy-id:controllers:path", e.g. "0::/" or "4:memory:/docker/abc".
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			cgroups[controller] = fields[2]
+		}
+	}
+	return cgroups, scanner.Err()
+}
+
+// readCgroupLimit reads the limit file of the cgroup, or of the root of the hierarchy if the cgroup is not
+// visible, e.g. in a container with its own cgroup namespace.
+func readCgroupLimit(root, cgroup, name string) (uint64, bool) {
+	data, err := os.ReadFile(filepath.Join(root, cgroup, name))
+	if err != nil {
+		data, err = os.ReadFile(filepath.Join(root, name))
+	}
+	if err != nil {
+		return 0, false
+	}
+
+	value := strings.TrimSpace(string(data))
+	if value == "max" {
+		return 0, false
+	}
+	limit, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || limit == 0 || limit >= cgroupUnlimited {
+		return 0, false
+	}
+	return limit, true
+}
+
+// MemoryAdmission admits tasks while the memory usage is below a share of the limit. It has a hysteresis:
+// once the usage has exceeded the high watermark, tasks are rejected until it drops below the low watermark.
+// A nil MemoryAdmission or one without a limit admits every task.
+type MemoryAdmission struct {
+	source MemorySource
+	limit  uint64
+	high   uint64
+	low    uint64
+
+	mu        sync.Mutex
+	rejecting bool
+}
+
+// NewMemoryAdmission creates the admission of a memory source. The limit is the budget in bytes, or the limit
+// of the cgroup if the budget is zero. The watermarks are percentages of the limit, the low one is capped by
+// the high one.
+func NewMemoryAdmission(source MemorySource, budget, highPct, lowPct uint64) *MemoryAdmission {
+	limit := budget
+	if limit == 0 {
+		limit, _ = CgroupMemoryLimit()
+	}
+	if highPct == 0 {
+		// default memory limit is 75%
+		highPct = 75
+	}
+	lowPct = min(lowPct, highPct)
+
+	return &MemoryAdmission{
+		source: source,
+		limit:  limit,
+		high:   limit / 100 * highPct,
+		low:    limit / 100 * lowPct,
+	}
+}
+
+// Limit returns the memory limit in bytes, zero if there is none.
+func (a *MemoryAdmission) Limit() uint64 {
+	if a == nil {
+		return 0
+	}
+	return a.limit
+}
+
+// Admit reports whether a task can be started with the current memory usage.
+func (a *MemoryAdmission) Admit() bool {
+	if a == nil || a.limit == 0 {
+		return true
+	}
+
+	stats := a.source.MemoryStats()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch {
+	case !a.rejecting && stats.Total > a.high:
+		a.rejecting = true
+		LogWarning(fmt.Sprintf("Memory usage %d bytes (heap %d bytes) exceeds %d of %d bytes, rejecting tasks",
+			stats.Total, stats.Heap, a.high, a.limit))
+	case a.rejecting && stats.Total < a.low:
+		a.rejecting = false
+		LogInfo(fmt.Sprintf("Memory usage %d bytes dropped below %d bytes, admitting tasks", stats.Total, a.low))
+	}
+	return !a.rejecting
+}
@@ -0,0 +1,290 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	// The tests log to the global logger, which would write to logs/app.log.
+	log = logrus.New()
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// fakeMemory is a memory source with a settable usage.
+type fakeMemory struct {
+	total atomic.Uint64
+}
+
+func (m *fakeMemory) MemoryStats() MemoryStats {
+	total := m.total.Load()
+	return MemoryStats{Heap: total / 2, Total: total}
+}
+
+// taskFunc adapts a function to the Task interface.
+type taskFunc func() error
+
+func (f taskFunc) Execute() error {
+	return f()
+}
+
+// fakeCgroup replaces the cgroups of the process and the cgroup hierarchies with the files of a temporary directory.
+// The files map paths relative to the root of the hierarchies to their contents, a nil proc means that the cgroups of
+// the process can't be read.
+func fakeCgroup(t *testing.T, proc *string, files map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+
+	oldProc, oldRoot := procCgroup, cgroupRoot
+	t.Cleanup(func() { procCgroup, cgroupRoot = oldProc, oldRoot })
+
+	procCgroup = filepath.Join(dir, "proc", "cgroup")
+	cgroupRoot = filepath.Join(dir, "cgroup")
+
+	if proc != nil {
+		writeFile(t, procCgroup, *proc)
+	}
+	for name, content := range files {
+		writeFile(t, filepath.Join(cgroupRoot, name), content)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
+
+func TestMemoryAdmissionHysteresis(t *testing.T) {
+	source := &fakeMemory{}
+	// Rejects above 750 bytes until the usage drops below 650 bytes.
+	admission := NewMemoryAdmission(source, 1000, 75, 65)
+
+	steps := []struct {
+		total uint64
+		admit bool
+	}{
+		{700, true},
+		{750, true},
+		{760, false}, // above the high watermark
+		{700, false}, // still above the low watermark
+		{650, false},
+		{649, true}, // below the low watermark
+		{740, true}, // admitting again up to the high watermark
+		{751, false},
+	}
+	for i, step := range steps {
+		source.total.Store(step.total)
+		if got := admission.Admit(); got != step.admit {
+			t.Fatalf("step %d: Admit() with %d bytes = %v, want %v", i, step.total, got, step.admit)
+		}
+	}
+}
+
+func TestMemoryAdmissionWatermarks(t *testing.T) {
+	tests := []struct {
+		name            string
+		highPct, lowPct uint64
+		high, low       uint64
+	}{
+		{"explicit", 80, 60, 800, 600},
+		{"default high", 0, 65, 750, 650},
+		{"low capped by high", 75, 90, 750, 750},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admission := NewMemoryAdmission(&fakeMemory{}, 1000, tt.highPct, tt.lowPct)
+			if admission.high != tt.high || admission.low != tt.low {
+				t.Errorf("watermarks = %d/%d, want %d/%d", admission.high, admission.low, tt.high, tt.low)
+			}
+		})
+	}
+}
+
+func TestMemoryAdmissionWithoutLimit(t *testing.T) {
+	fakeCgroup(t, nil, nil)
+
+	source := &fakeMemory{}
+	source.total.Store(1 << 40)
+
+	var nilAdmission *MemoryAdmission
+	for name, admission := range map[string]*MemoryAdmission{
+		"nil":      nilAdmission,
+		"no limit": NewMemoryAdmission(source, 0, 75, 65),
+	} {
+		if admission.Limit() != 0 {
+			t.Errorf("%s: Limit() = %d, want 0", name, admission.Limit())
+		}
+		if !admission.Admit() {
+			t.Errorf("%s: Admit() = false, want true", name)
+		}
+	}
+}
+
+func TestCgroupMemoryLimit(t *testing.T) {
+	tests := []struct {
+		name  string
+		proc  *string
+		files map[string]string
+		limit uint64
+		ok    bool
+	}{
+		{
+			name: "v2",
+			proc: ptr("0::/app\n"),
+			files: map[string]string{
+				"cgroup.controllers": "cpu memory",
+				"app/memory.max":     "1073741824\n",
+			},
+			limit: 1 << 30,
+			ok:    true,
+		},
+		{
+			name: "v2 unlimited",
+			proc: ptr("0::/app\n"),
+			files: map[string]string{
+				"cgroup.controllers": "cpu memory",
+				"app/memory.max":     "max\n",
+			},
+		},
+		{
+			name: "v2 namespaced",
+			// The cgroup of the process is not visible in its own cgroup namespace.
+			proc: ptr("0::/kubepods/pod1/abc\n"),
+			files: map[string]string{
+				"cgroup.controllers": "cpu memory",
+				"memory.max":         "536870912\n",
+			},
+			limit: 1 << 29,
+			ok:    true,
+		},
+		{
+			name: "v1",
+			proc: ptr("5:cpu,cpuacct:/docker/abc\n4:memory:/docker/abc\n0::/\n"),
+			files: map[string]string{
+				"memory/docker/abc/memory.limit_in_bytes": "268435456\n",
+			},
+			limit: 1 << 28,
+			ok:    true,
+		},
+		{
+			name: "v1 unlimited",
+			proc: ptr("4:memory:/docker/abc\n"),
+			files: map[string]string{
+				"memory/docker/abc/memory.limit_in_bytes": "9223372036854771712\n",
+			},
+		},
+		{
+			name: "v1 namespaced",
+			proc: ptr("4:memory:/docker/abc\n"),
+			files: map[string]string{
+				"memory/memory.limit_in_bytes": "134217728\n",
+			},
+			limit: 1 << 27,
+			ok:    true,
+		},
+		{
+			name:  "invalid",
+			proc:  ptr("0::/\n"),
+			files: map[string]string{"cgroup.controllers": "memory", "memory.max": "lots"},
+		},
+		{
+			name: "no cgroups",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeCgroup(t, tt.proc, tt.files)
+
+			limit, ok := CgroupMemoryLimit()
+			if limit != tt.limit || ok != tt.ok {
+				t.Errorf("CgroupMemoryLimit() = %d, %v, want %d, %v", limit, ok, tt.limit, tt.ok)
+			}
+		})
+	}
+}
+
+func TestNewMemoryAdmissionLimit(t *testing.T) {
+	fakeCgroup(t, ptr("0::/\n"), map[string]string{
+		"cgroup.controllers": "memory",
+		"memory.max":         "2000\n",
+	})
+
+	tests := []struct {
+		name   string
+		budget uint64
+		limit  uint64
+	}{
+		{"cgroup", 0, 2000},
+		{"budget below cgroup", 1000, 1000},
+		{"budget above cgroup", 4000, 4000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admission := NewMemoryAdmission(&fakeMemory{}, tt.budget, 75, 65)
+			if admission.Limit() != tt.limit {
+				t.Errorf("Limit() = %d, want %d", admission.Limit(), tt.limit)
+			}
+			if want := tt.limit / 100 * 75; admission.high != want {
+				t.Errorf("high watermark = %d, want %d", admission.high, want)
+			}
+		})
+	}
+}
+
+func TestWorkerSpawnerRejectsAboveMemoryLimit(t *testing.T) {
+	source := &fakeMemory{}
+	spawner := NewWorkerSpawnerWithMemoryLimit(NewMemoryAdmission(source, 1000, 75, 65))
+
+	var executed atomic.Int32
+	task := taskFunc(func() error {
+		executed.Add(1)
+		return nil
+	})
+
+	source.total.Store(800)
+	if err := spawner.Run(context.Background(), task); !errors.Is(err, ErrMemoryLimit) {
+		t.Fatalf("Run() above the limit = %v, want %v", err, ErrMemoryLimit)
+	}
+
+	source.total.Store(700)
+	if err := spawner.Run(context.Background(), task); !errors.Is(err, ErrMemoryLimit) {
+		t.Fatalf("Run() above the low watermark = %v, want %v", err, ErrMemoryLimit)
+	}
+
+	source.total.Store(600)
+	if err := spawner.Run(context.Background(), task); err != nil {
+		t.Fatalf("Run() below the low watermark = %v, want nil", err)
+	}
+
+	if err := spawner.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := spawner.Run(context.Background(), task); !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("Run() after Shutdown = %v, want %v", err, ErrPoolClosed)
+	}
+
+	if executed.Load() != 1 {
+		t.Errorf("executed %d tasks, want 1", executed.Load())
+	}
+	stats := spawner.Stats()
+	if stats.Completed != 1 || stats.Rejected != 3 || stats.Running != 0 {
+		t.Errorf("Stats() = %+v, want 1 completed and 3 rejected", stats)
+	}
+}
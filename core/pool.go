@@ -0,0 +1,124 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Pool schedules the tasks of the handlers. The implementations differ in how many tasks they execute at once.
+type Pool interface {
+	// Run submits a task. The context of the task is derived from ctx. A rejected task is not executed,
+	// and ErrPoolFull, ErrPoolClosed or ErrMemoryLimit is returned.
+	Run(ctx context.Context, task Task) error
+	// Stats returns the current counters of the pool.
+	Stats() PoolStats
+	// Shutdown stops accepting tasks and waits until the running tasks have finished or ctx is done.
+	// If ctx is done first, the contexts of the remaining tasks are cancelled and ctx.Err() is returned.
+	Shutdown(ctx context.Context) error
+	// Wait waits until the tasks of a shut down pool have returned.
+	Wait()
+}
+
+// PoolStats are the counters of a pool.
+type PoolStats struct {
+	// Workers is the maximum number of tasks that are executed at once, zero for unlimited.
+	Workers int
+	// Running is the number of tasks that are executed.
+	Running int64
+	// Queued is the number of tasks that wait for a worker.
+	Queued int
+	// Completed is the number of tasks that have returned.
+	Completed uint64
+	// Rejected is the number of tasks that have not been accepted.
+	Rejected uint64
+}
+
+// Scheduling strategies of the pools.
+const (
+	// StrategyPool executes the tasks on a fixed number of workers with a bounded queue.
+	StrategyPool = "pool"
+	// StrategySpawner executes every task in its own goroutine while the memory usage is below the limit.
+	StrategySpawner = "spawner"
+	// StrategyHybrid executes the tasks on a fixed number of workers, and admits them to the queue only
+	// while the memory usage is below the limit.
+	StrategyHybrid = "hybrid"
+)
+
+// PoolConfig are the settings of a pool.
+type PoolConfig struct {
+	Strategy string
+	// Workers and QueueSize are the number of workers and the size of the queue of the pool and the hybrid.
+	Workers   int
+	QueueSize int
+	// QueueTimeout is how long a task waits for room in the queue, see WorkerPool.
+	QueueTimeout time.Duration
+	// TaskTimeout is the deadline of the context of a task, zero for none.
+	TaskTimeout time.Duration
+	// Memory admits the tasks of the spawner and the hybrid.
+	Memory *MemoryAdmission
+}
+
+// StartPool creates and starts the pool of the strategy.
+func StartPool(config PoolConfig) (Pool, error) {
+	switch config.Strategy {
+	case StrategyPool:
+		pool := NewPool(config.Workers, config.QueueSize)
+		pool.QueueTimeout = config.QueueTimeout
+		pool.TaskTimeout = config.TaskTimeout
+		pool.Start()
+		return pool, nil
+	case StrategySpawner:
+		spawner := NewWorkerSpawnerWithMemoryLimit(config.Memory)
+		spawner.TaskTimeout = config.TaskTimeout
+		return spawner, nil
+	case StrategyHybrid:
+		pool := NewPool(config.Workers, config.QueueSize)
+		pool.QueueTimeout = config.QueueTimeout
+		pool.TaskTimeout = config.TaskTimeout
+		pool.Start()
+		return &HybridPool{WorkerPool: pool, memory: config.Memory}, nil
+	}
+	return nil, fmt.Errorf("unknown scheduling strategy %q (pool, spawner, hybrid)", config.Strategy)
+}
+
+// HybridPool is a worker pool that only queues tasks while the memory usage is below the limit.
+type HybridPool struct {
+	*WorkerPool
+	memory *MemoryAdmission
+}
+
+// Run submits a task to the worker pool if the memory usage admits it.
+func (hp *HybridPool) Run(ctx context.Context, task Task) error {
+	if !hp.memory.Admit() {
+		hp.counters.rejected.Add(1)
+		return ErrMemoryLimit
+	}
+	return hp.WorkerPool.Run(ctx, task)
+}
+
+// counters count the tasks of a pool.
+type counters struct {
+	running   atomic.Int64
+	completed atomic.Uint64
+	rejected  atomic.Uint64
+}
+
+// execute executes a job and counts it.
+func (c *counters) execute(j job, pool context.Context, timeout time.Duration) error {
+	c.running.Add(1)
+	defer func() {
+		c.running.Add(-1)
+		c.completed.Add(1)
+	}()
+	return j.execute(pool, timeout)
+}
+
+// reject counts the rejection of a task and returns the error.
+func (c *counters) reject(err error) error {
+	if err != nil {
+		c.rejected.Add(1)
+	}
+	return err
+}
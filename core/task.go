@@ -1,6 +1,87 @@
 package core
 
+import (
+	"context"
+	"time"
+)
+
 type Task interface {
 	Execute() error
 }
- 
\ No newline at end of file
+
+// ContextTask is a task that stops when its context is done, e.g. on shutdown, on a timeout or when the
+// client has gone away.
+type ContextTask interface {
+	Task
+	ExecuteContext(ctx context.Context) error
+}
+
+// WithContext adapts a task to the ContextTask interface. A task that doesn't implement it
+// ignores the context, so it can't be cancelled.
+func WithContext(task Task) ContextTask {
+	if t, ok := task.(ContextTask); ok {
+		return t
+	}
+	return contextAdapter{task}
+}
+
+// contextAdapter executes a task without a context.
+type contextAdapter struct {
+	Task
+}
+
+// ExecuteContext executes the task, ignoring the context.
+func (a contextAdapter) ExecuteContext(ctx context.Context) error {
+	return a.Execute()
+}
+
+// job is a queued task with the context of its submission.
+type job struct {
+	ctx  context.Context
+	task ContextTask
+}
+
+// newJob creates the job of a task, the context defaults to the background context.
+func newJob(ctx context.Context, task Task) job {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return job{ctx: ctx, task: WithContext(task)}
+}
+
+// execute executes the task with a context that is also cancelled with the context of the pool,
+// and has the deadline of the timeout, zero for none.
+func (j job) execute(pool context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithCancel(j.ctx)
+	defer cancel()
+
+	stop := context.AfterFunc(pool, cancel)
+	defer stop()
+
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		defer cancelTimeout()
+	}
+
+	return j.task.ExecuteContext(ctx)
+}
+
+// shutdown closes a pool and waits until its tasks have finished or ctx is done. If ctx is done first,
+// the contexts of the remaining tasks are cancelled and ctx.Err() is returned without waiting for them.
+func shutdown(ctx context.Context, closePool func(), cancel context.CancelFunc) error {
+	done := make(chan struct{})
+	go func() {
+		closePool()
+		cancel()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		cancel()
+		return ctx.Err()
+	}
+}
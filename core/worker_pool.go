@@ -1,22 +1,51 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 )
 
+// ErrPoolFull is returned when a task is rejected because the queue of the worker pool is full.
+var ErrPoolFull = errors.New("worker pool is full")
+
+// ErrPoolClosed is returned when a task is submitted to a closed worker pool.
+var ErrPoolClosed = errors.New("worker pool is closed")
+
 // WorkerPool represents a simple worker pool implementation.
+// At most workerNum tasks are executed at once, the others wait in the bounded task channel.
 type WorkerPool struct {
 	wg        sync.WaitGroup
 	workerNum int
-	taskCh    chan Task
+	taskCh    chan job
+
+	// QueueTimeout is how long Run waits for room in the queue: zero rejects the task at once
+	// if the queue is full and a negative timeout waits until there is room.
+	QueueTimeout time.Duration
+	// TaskTimeout is the deadline of the context of a task, zero for none.
+	TaskTimeout time.Duration
+
+	// mu guards closed, so that no task is sent on the closed channel.
+	mu     sync.RWMutex
+	closed bool
+
+	// ctx is cancelled when the pool is shut down, which cancels the contexts of the tasks.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	counters counters
 }
 
 // NewPool creates a new WorkPool with the specified number of workers and buffer size for tasks.
 func NewPool(workerNumber int, bufferSize int) *WorkerPool {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &WorkerPool{
-		workerNum: workerNumber,
-		taskCh:    make(chan Task, bufferSize),
+		workerNum: max(workerNumber, 1),
+		taskCh:    make(chan job, max(bufferSize, 0)),
+		ctx:       ctx,
+		cancel:    cancel,
 	}
 }
 
@@ -30,51 +59,136 @@ func (wp *WorkerPool) Wait() {
 	wp.wg.Wait()
 }
 
-// Run submits a task to the worker pool.
-func (wp *WorkerPool) Run(task Task) {
-	wp.wg.Add(1)
-	go func(t Task) {
-		defer wp.Done()
-
-		// Perform cleanup and exit if an error occurs
-		defer func() {
-			if r := recover(); r != nil {
-				// Handle the panic or cleanup as needed
-				wp.handleError(fmt.Errorf("panic: %v", r))
-			}
-		}()
+// Run submits a task to the worker pool, waiting up to QueueTimeout for room in the queue.
+// The context of the task is derived from ctx.
+func (wp *WorkerPool) Run(ctx context.Context, task Task) error {
+	switch {
+	case wp.QueueTimeout < 0:
+		return wp.counters.reject(wp.Submit(ctx, task))
+	case wp.QueueTimeout == 0:
+		return wp.counters.reject(wp.TrySubmit(ctx, task))
+	}
+	return wp.counters.reject(wp.SubmitTimeout(ctx, task, wp.QueueTimeout))
+}
 
-		// Execute the task and handle errors
-		if err := t.Execute(); err != nil {
-			wp.handleError(err)
-			// Perform any additional cleanup here if needed
-		}
-	}(task)
+// Stats returns the current counters of the pool.
+func (wp *WorkerPool) Stats() PoolStats {
+	return PoolStats{
+		Workers:   wp.workerNum,
+		Running:   wp.counters.running.Load(),
+		Queued:    len(wp.taskCh),
+		Completed: wp.counters.completed.Load(),
+		Rejected:  wp.counters.rejected.Load(),
+	}
+}
+
+// Submit queues a task and blocks until there is room in the queue or ctx is done.
+func (wp *WorkerPool) Submit(ctx context.Context, task Task) error {
+	wp.mu.RLock()
+	defer wp.mu.RUnlock()
+
+	if wp.closed {
+		return ErrPoolClosed
+	}
+
+	select {
+	case wp.taskCh <- newJob(ctx, task):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SubmitTimeout queues a task, waiting up to timeout for room in the queue.
+// ErrPoolFull is returned if the queue is still full after the timeout.
+func (wp *WorkerPool) SubmitTimeout(ctx context.Context, task Task, timeout time.Duration) error {
+	wp.mu.RLock()
+	defer wp.mu.RUnlock()
+
+	if wp.closed {
+		return ErrPoolClosed
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case wp.taskCh <- newJob(ctx, task):
+		return nil
+	case <-timer.C:
+		return ErrPoolFull
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// TrySubmit queues a task without blocking. ErrPoolFull is returned if the queue is full.
+func (wp *WorkerPool) TrySubmit(ctx context.Context, task Task) error {
+	wp.mu.RLock()
+	defer wp.mu.RUnlock()
+
+	if wp.closed {
+		return ErrPoolClosed
+	}
+
+	select {
+	case wp.taskCh <- newJob(ctx, task):
+		return nil
+	default:
+		return ErrPoolFull
+	}
 }
 
 // Start initializes and starts the worker pool.
 func (wp *WorkerPool) Start() {
 	wp.wg.Add(wp.workerNum) // Increment WaitGroup for each worker
 	for i := 0; i < wp.workerNum; i++ {
-		go func(id int) {
-			// Print worker id when starting
-			fmt.Printf("Worker %d spawned\n", id)
+		go func() {
 			defer wp.wg.Done()
-			for task := range wp.taskCh {
-				task.Execute()
+			for j := range wp.taskCh {
+				wp.execute(j)
 			}
-		}(i)
+		}()
+	}
+	LogInfo(fmt.Sprintf("Started %d workers with a queue of %d tasks", wp.workerNum, cap(wp.taskCh)))
+}
+
+// execute executes a task, so that a failing task doesn't stop the worker.
+func (wp *WorkerPool) execute(j job) {
+	// Perform cleanup and continue if a panic occurs
+	defer func() {
+		if r := recover(); r != nil {
+			wp.handleError(fmt.Errorf("panic: %v", r))
+		}
+	}()
+
+	// Execute the task and handle errors
+	if err := wp.counters.execute(j, wp.ctx, wp.TaskTimeout); err != nil {
+		wp.handleError(err)
 	}
 }
 
-// handleError is a simple function to handle errors.
+// handleError logs the error of a task.
 func (wp *WorkerPool) handleError(err error) {
-	// Handle the error here
-	fmt.Println("Error:", err)
+	LogError("Error (while executing task)", err)
 }
 
-// Close closes the task channel and waits for all workers to finish.
+// Close closes the task channel and waits for the workers to finish the queued tasks.
+// Tasks submitted afterwards are rejected with ErrPoolClosed.
 func (wp *WorkerPool) Close() {
-	close(wp.taskCh)
+	wp.mu.Lock()
+	if !wp.closed {
+		wp.closed = true
+		close(wp.taskCh)
+	}
+	wp.mu.Unlock()
+
 	wp.Wait() // Wait for all workers to finish before returning
 }
+
+// Shutdown closes the pool and waits until the queued and running tasks have finished or ctx is done.
+// If ctx is done first, the contexts of the remaining tasks are cancelled and ctx.Err() is returned
+// without waiting for them, see Wait.
+func (wp *WorkerPool) Shutdown(ctx context.Context) error {
+	return shutdown(ctx, wp.Close, wp.cancel)
+}
@@ -1,84 +1,102 @@
 package core
 
 import (
+	"context"
 	"fmt"
-	"runtime"
 	"sync"
+	"time"
 )
 
 // WorkerSpawnerWithMemoryLimit represents a worker pool with dynamic memory-based limits.
+// Every task is executed in its own goroutine, as long as the memory usage admits it.
 type WorkerSpawnerWithMemoryLimit struct {
-	wg           sync.WaitGroup
-	taskCh       chan Task
-	stopCh       chan struct{}
-	maxMemoryPct uint64 // Maximum allowed memory usage percentage
-}
+	wg     sync.WaitGroup
+	memory *MemoryAdmission // Admission of the tasks based on the memory usage
 
-// NewWorkerSpawnerWithMemoryLimit creates a new QueuedWorkPoolWithMemoryLimit with the specified memory limit.
-func NewWorkerSpawnerWithMemoryLimit(maxMemoryPct uint64) *WorkerSpawnerWithMemoryLimit {
-	if maxMemoryPct == 0 {
-		// default memory limit is 75%
-		maxMemoryPct = 75
-	}
+	// mu guards closed, so that no task is started after the spawner has been closed.
+	mu     sync.RWMutex
+	closed bool
 
-	LogInfo("Initializing worker spawner with memory limit...")
-	LogInfo(fmt.Sprintf("Memory limit: %d%%", maxMemoryPct))
+	// ctx is cancelled when the spawner is shut down, which cancels the contexts of the tasks.
+	ctx    context.Context
+	cancel context.CancelFunc
 
-	return &WorkerSpawnerWithMemoryLimit{
-		taskCh:       make(chan Task),
-		stopCh:       make(chan struct{}),
-		maxMemoryPct: maxMemoryPct,
-	}
+	counters counters
+
+	// TaskTimeout is the deadline of the context of a task, zero for none.
+	TaskTimeout time.Duration
 }
 
-// Start initializes and starts the worker pool.
-func (wp *WorkerSpawnerWithMemoryLimit) Start() {
-	for {
-		select {
-		case task, ok := <-wp.taskCh:
-			if !ok {
-				return // taskCh is closed
-			}
-			wp.wg.Add(1)
-			go func(t Task) {
-				defer wp.wg.Done()
-				defer func() {
-					if r := recover(); r != nil {
-						LogWarning(fmt.Sprintf("Recovered from panic in worker goroutine: %v", r))
-					}
-				}()
-				t.Execute()
-			}(task)
-		case <-wp.stopCh:
-			return // stop the goroutine when signaled
-		}
+// NewWorkerSpawnerWithMemoryLimit creates a new QueuedWorkPoolWithMemoryLimit with the specified memory admission.
+func NewWorkerSpawnerWithMemoryLimit(memory *MemoryAdmission) *WorkerSpawnerWithMemoryLimit {
+	LogInfo("Initializing worker spawner with memory limit...")
+	if memory.Limit() == 0 {
+		LogWarning("No memory budget or cgroup memory limit, tasks are not limited by memory")
+	} else {
+		LogInfo(fmt.Sprintf("Memory limit: %d bytes, rejecting above %d bytes until below %d bytes", memory.limit, memory.high, memory.low))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &WorkerSpawnerWithMemoryLimit{
+		memory: memory,
+		ctx:    ctx,
+		cancel: cancel,
 	}
 }
 
-// Run submits a task to the worker pool.
-func (wp *WorkerSpawnerWithMemoryLimit) Run(task Task) (bool, error) {
-	var memStats runtime.MemStats
-	runtime.ReadMemStats(&memStats)
+// Run submits a task to the worker pool. The context of the task is derived from ctx.
+func (wp *WorkerSpawnerWithMemoryLimit) Run(ctx context.Context, task Task) error {
+	wp.mu.RLock()
+	defer wp.mu.RUnlock()
 
-	// Calculate memory usage percentage
-	usedMemoryPct := (memStats.Alloc * 100) / memStats.TotalAlloc
+	if wp.closed {
+		return wp.counters.reject(ErrPoolClosed)
+	}
 
 	// If memory usage exceeds the limit, reject the task
-	if usedMemoryPct > wp.maxMemoryPct {
-		LogWarning(fmt.Sprintf("Memory usage exceeds %d%%. Task rejected.", wp.maxMemoryPct))
-		return false, fmt.Errorf("task rejected: memory limit exceeded")
+	if !wp.memory.Admit() {
+		return wp.counters.reject(ErrMemoryLimit)
 	}
 
-	select {
-	case wp.taskCh <- task:
-		return true, nil
-	default:
-		return false, fmt.Errorf("task rejected: queue full")
+	wp.wg.Add(1)
+	go func(j job) {
+		defer wp.wg.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				LogWarning(fmt.Sprintf("Recovered from panic in worker goroutine: %v", r))
+			}
+		}()
+		wp.counters.execute(j, wp.ctx, wp.TaskTimeout)
+	}(newJob(ctx, task))
+	return nil
+}
+
+// Stats returns the current counters of the spawner.
+func (wp *WorkerSpawnerWithMemoryLimit) Stats() PoolStats {
+	return PoolStats{
+		Running:   wp.counters.running.Load(),
+		Completed: wp.counters.completed.Load(),
+		Rejected:  wp.counters.rejected.Load(),
 	}
 }
 
 // Wait waits for all goroutines to finish.
+func (wp *WorkerSpawnerWithMemoryLimit) Wait() {
+	wp.wg.Wait()
+}
+
+// Close stops accepting tasks and waits for all goroutines to finish.
 func (wp *WorkerSpawnerWithMemoryLimit) Close() {
-	close(wp.taskCh)
+	wp.mu.Lock()
+	wp.closed = true
+	wp.mu.Unlock()
+
 	wp.wg.Wait()
 }
+
+// Shutdown closes the spawner and waits until the running tasks have finished or ctx is done.
+// If ctx is done first, the contexts of the remaining tasks are cancelled and ctx.Err() is returned
+// without waiting for them.
+func (wp *WorkerSpawnerWithMemoryLimit) Shutdown(ctx context.Context) error {
+	return shutdown(ctx, wp.Close, wp.cancel)
+}
@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/media_uploader/auth"
+	"github.com/media_uploader/core"
+	"github.com/media_uploader/ratelimit"
+	"github.com/media_uploader/tasks"
+)
+
+// adminKeysPath is the path of the API key admin endpoints.
+const adminKeysPath = "/admin/keys"
+
+// APIKeys are the API keys of the services, nil disables them.
+var APIKeys *auth.KeyStore
+
+// InitializeAPIKeys enables the API keys of the file. If there are no keys yet, an admin key is created
+// and printed once, so the first keys can be created through the admin endpoints.
+func InitializeAPIKeys(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	store, err := auth.OpenKeyStore(path)
+	if err != nil {
+		return err
+	}
+	APIKeys = store
+
+	// The keys may override the cap of concurrent uploads, which needs a cap to override.
+	if ConcurrentUploads == nil {
+		ConcurrentUploads = ratelimit.NewConcurrency(0, 5*time.Second)
+	}
+
+	if !store.Empty() {
+		return nil
+	}
+
+	key, value, err := store.Create(auth.APIKey{Name: "bootstrap", Scopes: []string{auth.ScopeAdmin}})
+	if err != nil {
+		return err
+	}
+	core.LogWarning(fmt.Sprintf("Created bootstrap admin key %s", key.Id))
+	fmt.Printf("Bootstrap admin API key (shown only once, rotate or revoke it after creating other keys): %s\n", value)
+	return nil
+}
+
+// keyRequest is the body of a request that creates an API key.
+type keyRequest struct {
+	Name                 string   `json:"name"`
+	Scopes               []string `json:"scopes"`
+	Tenant               string   `json:"tenant"`
+	Prefix               string   `json:"prefix"`
+	MaxSize              int64    `json:"maxSize"`
+	MaxConcurrentUploads int      `json:"maxConcurrentUploads"`
+	// ExpiresIn is the lifetime of the key in seconds, zero for a key that doesn't expire.
+	ExpiresIn int64 `json:"expiresIn"`
+}
+
+// rotateRequest is the body of a request that rotates an API key.
+type rotateRequest struct {
+	// GracePeriod is the number of seconds the previous value is still accepted.
+	GracePeriod int64 `json:"gracePeriod"`
+}
+
+// keyResponse is the body of a created or rotated API key. The value is returned only once.
+type keyResponse struct {
+	Key   auth.APIKey `json:"key"`
+	Value string      `json:"value,omitempty"`
+}
+
+// Http API key admin handler:
+//
+//	GET    /admin/keys             lists the keys
+//	POST   /admin/keys             creates a key
+//	GET    /admin/keys/{id}        returns a key
+//	POST   /admin/keys/{id}/rotate rotates a key
+//	DELETE /admin/keys/{id}        revokes a key
+//
+// The requests have to be authenticated with an API key with the admin scope.
+func AdminKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if APIKeys == nil {
+		http.Error(w, "API keys are disabled", http.StatusNotFound)
+		return
+	}
+
+	claims, ok := authenticate(w, r, auth.ScopeAdmin)
+	if !ok {
+		return
+	}
+	// Tokens of end users are not restricted by scopes, but they can't administrate keys.
+	if claims == nil || claims.Key == nil {
+		forbidden(w, "an API key with the admin scope is required")
+		return
+	}
+
+	id, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, adminKeysPath), "/"), "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, APIKeys.List())
+	case id == "" && r.Method == http.MethodPost:
+		createKey(w, r, claims)
+	case id == "":
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	case action == "" && r.Method == http.MethodGet:
+		key, err := APIKeys.Get(id)
+		if err != nil {
+			keyError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, key)
+	case action == "" && r.Method == http.MethodDelete:
+		key, err := APIKeys.Revoke(id)
+		if err != nil {
+			keyError(w, err)
+			return
+		}
+		core.LogInfo(fmt.Sprintf("API key %s revoked by %s", id, claims.Subject))
+		writeJSON(w, http.StatusOK, key)
+	case action == "":
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	case action == "rotate" && r.Method == http.MethodPost:
+		rotateKey(w, r, id, claims)
+	case action == "rotate":
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// createKey creates an API key.
+func createKey(w http.ResponseWriter, r *http.Request, claims *auth.Claims) {
+	var request keyRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&request); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if request.MaxSize < 0 || request.MaxConcurrentUploads < 0 || request.ExpiresIn < 0 {
+		http.Error(w, "invalid limits", http.StatusBadRequest)
+		return
+	}
+	if err := auth.ValidateScopes(request.Scopes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := tasks.ValidateMediaIdPrefix(request.Prefix); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	template := auth.APIKey{
+		Name:                 request.Name,
+		Scopes:               request.Scopes,
+		Tenant:               request.Tenant,
+		Prefix:               request.Prefix,
+		MaxSize:              request.MaxSize,
+		MaxConcurrentUploads: request.MaxConcurrentUploads,
+	}
+	if request.ExpiresIn > 0 {
+		expiresAt := time.Now().UTC().Add(time.Duration(request.ExpiresIn) * time.Second)
+		template.ExpiresAt = &expiresAt
+	}
+
+	key, value, err := APIKeys.Create(template)
+	if err != nil {
+		keyError(w, err)
+		return
+	}
+
+	core.LogInfo(fmt.Sprintf("API key %s (%s) created by %s", key.Id, key.Name, claims.Subject))
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, keyResponse{Key: key, Value: value})
+}
+
+// rotateKey replaces the value of an API key.
+func rotateKey(w http.ResponseWriter, r *http.Request, id string, claims *auth.Claims) {
+	var request rotateRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if request.GracePeriod < 0 {
+		http.Error(w, "invalid gracePeriod", http.StatusBadRequest)
+		return
+	}
+
+	key, value, err := APIKeys.Rotate(id, time.Duration(request.GracePeriod)*time.Second)
+	if err != nil {
+		keyError(w, err)
+		return
+	}
+
+	core.LogInfo(fmt.Sprintf("API key %s rotated by %s", id, claims.Subject))
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, keyResponse{Key: key, Value: value})
+}
+
+// keyError writes the response of a failed key operation.
+func keyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, auth.ErrKeyNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, auth.ErrInvalidKey):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		core.LogError("Error (while updating API keys)", err)
+		http.Error(w, "failed to update API keys", http.StatusInternalServerError)
+	}
+}
+
+// writeJSON writes a JSON response.
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
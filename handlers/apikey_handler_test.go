@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/media_uploader/auth"
+)
+
+func TestCreateKeyValidatesPrefix(t *testing.T) {
+	store, err := auth.OpenKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, admin, err := store.Create(auth.APIKey{Name: "admin", Scopes: []string{auth.ScopeAdmin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldKeys := APIKeys
+	APIKeys = store
+	t.Cleanup(func() { APIKeys = oldKeys })
+
+	tests := []struct {
+		prefix string
+		status int
+	}{
+		{"", http.StatusCreated},
+		{"tenant-a_", http.StatusCreated},
+		{"tenant-a/", http.StatusBadRequest},
+		{"../", http.StatusBadRequest},
+		{"-tenant", http.StatusBadRequest},
+		{string(bytes.Repeat([]byte("a"), 100)), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		body, _ := json.Marshal(keyRequest{Name: "service", Scopes: []string{auth.ScopeUpload}, Prefix: tt.prefix})
+		req := httptest.NewRequest(http.MethodPost, adminKeysPath, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+admin)
+		recorder := httptest.NewRecorder()
+
+		AdminKeysHandler(recorder, req)
+		if recorder.Code != tt.status {
+			t.Errorf("prefix %q: status = %d, want %d", tt.prefix, recorder.Code, tt.status)
+		}
+	}
+}
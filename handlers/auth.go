@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/media_uploader/auth"
+	"github.com/media_uploader/core"
+	"github.com/media_uploader/tasks"
+)
+
+// Authenticator verifies the tokens of the clients, nil disables authentication.
+var Authenticator *auth.Verifier
+
+// InitializeAuth enables JWT authentication with an HS256 secret and/or the keys of a JWKS file or URL.
+// The tenant of a client is taken from the tenant claim.
+func InitializeAuth(secret, jwksSource, issuer, audience, tenantClaim string) error {
+	if secret == "" && jwksSource == "" {
+		return nil
+	}
+
+	keys := auth.NewKeySet()
+	if secret != "" {
+		keys.AddSecret([]byte(secret))
+	}
+	if jwksSource != "" {
+		if err := keys.LoadJWKS(jwksSource); err != nil {
+			return err
+		}
+	}
+
+	Authenticator = &auth.Verifier{
+		Keys:        keys,
+		Issuer:      issuer,
+		Audience:    audience,
+		TenantClaim: tenantClaim,
+		Leeway:      30 * time.Second,
+	}
+	return nil
+}
+
+// authenticationEnabled reports whether the clients have to authenticate with a token or an API key.
+func authenticationEnabled() bool {
+	return Authenticator != nil || APIKeys != nil
+}
+
+// verifyToken verifies the token of the request.
+// The claims are nil if authentication is disabled.
+func verifyToken(r *http.Request) (*auth.Claims, error) {
+	if !authenticationEnabled() {
+		return nil, nil
+	}
+
+	token, err := auth.TokenFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	return verifyCredential(token)
+}
+
+// verifyCredential verifies a bearer token, which is either an API key or a JWT.
+func verifyCredential(token string) (*auth.Claims, error) {
+	if auth.IsAPIKey(token) && APIKeys != nil {
+		return APIKeys.Verify(token)
+	}
+	if Authenticator == nil {
+		return nil, auth.ErrInvalidToken
+	}
+	return Authenticator.Verify(token)
+}
+
+// authenticate verifies the token of the request and checks that it has the scope before any work is done
+// (and before a WebSocket upgrade). A 401 response is written if the request is not authenticated,
+// and a 403 response if the scope is missing.
+func authenticate(w http.ResponseWriter, r *http.Request, scope string) (*auth.Claims, bool) {
+	claims, err := verifyToken(r)
+	if err == nil {
+		if !claims.HasScope(scope) {
+			core.LogWarning(fmt.Sprintf("Request of %s from %s without scope %q", claims.Subject, r.RemoteAddr, scope))
+			forbidden(w, fmt.Sprintf("scope %q is required", scope))
+			return nil, false
+		}
+		return claims, true
+	}
+
+	core.LogWarning(fmt.Sprintf("Unauthenticated request from %s: %v", r.RemoteAddr, err))
+
+	description := "invalid token"
+	if errors.Is(err, auth.ErrExpiredToken) || errors.Is(err, auth.ErrMissingToken) || errors.Is(err, auth.ErrInvalidKey) {
+		description = err.Error()
+	}
+
+	if errors.Is(err, auth.ErrMissingToken) {
+		w.Header().Set("WWW-Authenticate", `Bearer`)
+	} else {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, description))
+	}
+	unauthorized(w, description)
+	return nil, false
+}
+
+// authorizeUpload authorizes an upload of the endpoint with an upload ticket or a token and
+// returns the options of the upload. A 401 response is written if the upload is not authorized.
+// The ticket is only verified, it has to be redeemed once the upload has been admitted (see redeemTicket).
+func authorizeUpload(w http.ResponseWriter, r *http.Request, endpoint string) (tasks.UploadOptions, bool) {
+	opts := uploadOptions(endpoint)
+
+	if value := ticketFromRequest(r); value != "" && Tickets != nil {
+		ticket, err := Tickets.Verify(value)
+		if err != nil {
+			core.LogWarning(fmt.Sprintf("Ticket of %s rejected: %v", r.RemoteAddr, err))
+			unauthorized(w, err.Error())
+			return opts, false
+		}
+		return opts.WithTicket(ticket), true
+	}
+
+	if RequireTickets {
+		unauthorized(w, "ticket is missing")
+		return opts, false
+	}
+
+	claims, ok := authenticate(w, r, auth.ScopeUpload)
+	if !ok {
+		return opts, false
+	}
+	return opts.WithClaims(claims), true
+}
+
+// redeemTicket redeems the ticket that authorizes the upload, if there is one.
+// An upload that is rejected before doesn't use up its ticket.
+func redeemTicket(r *http.Request, opts tasks.UploadOptions) error {
+	if opts.Ticket == nil {
+		return nil
+	}
+
+	if err := Tickets.Redeem(opts.Ticket); err != nil {
+		core.LogWarning(fmt.Sprintf("Ticket of %s rejected: %v", r.RemoteAddr, err))
+		return err
+	}
+	return nil
+}
+
+// forbidden writes a 403 response.
+func forbidden(w http.ResponseWriter, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(tasks.ServerMessage{Type: "error", Error: description})
+}
+
+// unauthorized writes a 401 response.
+func unauthorized(w http.ResponseWriter, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(tasks.ServerMessage{Type: "error", Error: description})
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/media_uploader/auth"
+	"github.com/media_uploader/ratelimit"
+	"github.com/media_uploader/storage"
+	"github.com/media_uploader/tasks"
+)
+
+// enableTickets enables upload tickets and two concurrent uploads per client for a test, and returns a ticket
+// of the subject. It has to be called before newTestServer, which stops the uploads before the cleanup.
+func enableTickets(t *testing.T, subject string) string {
+	t.Helper()
+
+	oldTickets, oldConcurrency := Tickets, ConcurrentUploads
+	Tickets = auth.NewTickets([]byte("ticket secret"))
+	ConcurrentUploads = ratelimit.NewConcurrency(2, time.Second)
+	t.Cleanup(func() { Tickets, ConcurrentUploads = oldTickets, oldConcurrency })
+
+	ticket, err := Tickets.Issue(auth.Ticket{Subject: subject, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ticket
+}
+
+// takeUploadSlots takes all upload slots of the client until the returned function is called.
+func takeUploadSlots(key string) func() {
+	taken := 0
+	for ConcurrentUploads.AcquireUpTo(key, 0) {
+		taken++
+	}
+	return func() {
+		for i := 0; i < taken; i++ {
+			ConcurrentUploads.Release(key)
+		}
+	}
+}
+
+// dialStream opens a WebSocket upload with the ticket and the request headers.
+func dialStream(server *httptest.Server, ticket string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/upload_stream?ticket=" + url.QueryEscape(ticket)
+	return websocket.DefaultDialer.Dial(url, header)
+}
+
+// formUpload uploads an MP4 file with the ticket in a multipart/form-data request and returns the status code.
+func formUpload(t *testing.T, server *httptest.Server, ticket string) int {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("mimeType", "video/mp4")
+	file, err := form.CreateFormFile("file", "video.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(testMP4(1000))
+	form.Close()
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/upload", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set(TicketHeader, ticket)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestStreamTicketRedeemedAfterUpgrade(t *testing.T) {
+	ticket := enableTickets(t, "alice")
+	server := newTestServer(t, storage.NewMemoryStorage())
+
+	// An upload that isn't admitted doesn't use up the ticket.
+	release := takeUploadSlots("sub:alice")
+	_, resp, err := dialStream(server, ticket, nil)
+	if !errors.Is(err, websocket.ErrBadHandshake) || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("upload without a free slot: %v, want status %d", err, http.StatusTooManyRequests)
+	}
+	release()
+
+	// Neither does an upgrade from a foreign origin.
+	_, resp, err = dialStream(server, ticket, http.Header{"Origin": {"https://foreign.example.com"}})
+	if !errors.Is(err, websocket.ErrBadHandshake) || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("upload from a foreign origin: %v, want status %d", err, http.StatusForbidden)
+	}
+
+	conn, _, err := dialStream(server, ticket, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteJSON(tasks.FirstChunk{Video: true, MimeType: "video/mp4", Size: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	var accepted tasks.ServerMessage
+	if err := conn.ReadJSON(&accepted); err != nil || accepted.Type != "accepted" {
+		t.Fatalf("first message = %+v, %v, want accepted", accepted, err)
+	}
+
+	// The ticket has been redeemed by the upgraded connection.
+	reused, _, err := dialStream(server, ticket, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reused.Close()
+	_, _, err = reused.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("upload with a used ticket: %v, want close code %d", err, websocket.ClosePolicyViolation)
+	}
+}
+
+func TestFormTicketRedeemedAfterAdmission(t *testing.T) {
+	ticket := enableTickets(t, "alice")
+	server := newTestServer(t, storage.NewMemoryStorage())
+
+	release := takeUploadSlots("sub:alice")
+	if status := formUpload(t, server, ticket); status != http.StatusTooManyRequests {
+		t.Fatalf("upload without a free slot: status = %d, want %d", status, http.StatusTooManyRequests)
+	}
+	release()
+
+	if status := formUpload(t, server, ticket); status != http.StatusCreated {
+		t.Fatalf("upload status = %d, want %d", status, http.StatusCreated)
+	}
+	if status := formUpload(t, server, ticket); status != http.StatusUnauthorized {
+		t.Errorf("upload with a used ticket: status = %d, want %d", status, http.StatusUnauthorized)
+	}
+}
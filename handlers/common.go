@@ -1,31 +1,112 @@
 package handlers
 
 import (
-	"net/http"
+	"context"
+	"fmt"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/media_uploader/audit"
+	"github.com/media_uploader/auth"
 	wp "github.com/media_uploader/core"
+	"github.com/media_uploader/storage"
+	"github.com/media_uploader/tasks"
 )
 
 // upgrader is a WebSocket upgrader with specified read and write buffer sizes.
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 256,
-	CheckOrigin:     func(r *http.Request) bool { return true },
+	CheckOrigin:     checkOrigin,
+	// Browsers pass the token as a second subprotocol, so a known one has to be selected.
+	Subprotocols: []string{auth.Subprotocol},
 }
 
-// WorkerPool is a global instance of the worker pool used by handlers.
-// It is initialized with 10 workers and a buffer size of 100 for task channel.
-var WorkerPool *wp.WorkerPool
+// WorkerPool is a global instance of the pool that schedules the upload tasks of the handlers.
+// The scheduling strategy is selected by InitializeWorkerConfig.
+var WorkerPool wp.Pool
 
-// WorkerSpawner is a global instance of the worker spawner with 75% memory limit based on runtime.
-// This gives us control for spawning workers based on memory usage as much as possible.
-// It's better for memory usage based workers than using a fixed number of workers (in some cases).
-var WorkerSpawner *wp.WorkerSpawnerWithMemoryLimit
+// rejectableTask is an upload task that can report to the client that it has not been accepted by the worker pool.
+type rejectableTask interface {
+	wp.Task
+	Reject(err error)
+}
+
+// runTask submits a task to the worker pool with a context that ends with the request, or the background context
+// for a hijacked connection. If the pool is full, closed or out of memory, the slot of the client is released and
+// the rejection is reported to the client by the task.
+func runTask(ctx context.Context, task rejectableTask, release func()) {
+	if err := WorkerPool.Run(ctx, releasingTask{Task: task, release: release}); err != nil {
+		wp.LogWarning(fmt.Sprintf("Upload rejected by the worker pool: %v", err))
+		release()
+		task.Reject(err)
+	}
+}
 
 var SaveUploadsTemporarily = false
 
-func InitializeWorkerConfig(workerCount, chBufferSize int, memoryLimit uint64) {
-	WorkerPool = wp.NewPool(workerCount, chBufferSize)
-	WorkerSpawner = wp.NewWorkerSpawnerWithMemoryLimit(memoryLimit)
+// MaxStreamsPerConn is the maximum number of concurrent uploads on one multiplexed connection.
+var MaxStreamsPerConn = 8
+
+// AllowClientMediaId allows clients to choose the media ids of their uploads.
+// Otherwise the ids are generated by the server.
+var AllowClientMediaId = false
+
+// UploadLimits are the global and per-MIME-type maximum upload sizes.
+var UploadLimits tasks.SizeLimits
+
+// MaxMessageSize is the maximum size of a single WebSocket message in bytes, zero for unlimited.
+var MaxMessageSize int64 = 8 * 1024 * 1024
+
+// Keepalive are the ping interval and the timeouts of WebSocket connections.
+var Keepalive = tasks.KeepaliveOptions{
+	PingInterval: 30 * time.Second,
+	PongTimeout:  10 * time.Second,
+	ReadTimeout:  60 * time.Second,
+}
+
+// TypePolicy decides what happens if the content of an upload doesn't match its declared MIME type.
+var TypePolicy = tasks.TypePolicyCorrect
+
+// UploadPolicies are the upload policies per endpoint and tenant, nil admits every upload.
+var UploadPolicies *tasks.PolicyConfig
+
+// Storage stores the uploaded files, nil for the S3 storage.
+var Storage storage.Storage
+
+// AuditLog records the lifecycle events of the uploads, nil disables it.
+var AuditLog *audit.Log
+
+// Scan are the settings of the malware scans, which are disabled without a scanner.
+var Scan = tasks.ScanOptions{QuarantinePrefix: "quarantine/"}
+
+// uploadOptions returns the settings of the upload tasks of the endpoint.
+func uploadOptions(endpoint string) tasks.UploadOptions {
+	return tasks.UploadOptions{
+		SaveUploadsTemporarily: SaveUploadsTemporarily,
+		AllowClientMediaId:     AllowClientMediaId,
+		Limits:                 UploadLimits,
+		MaxMessageSize:         MaxMessageSize,
+		Keepalive:              Keepalive,
+		ByteRate:               ByteRate,
+		Uploads:                ConcurrentUploads,
+		TypePolicy:             TypePolicy,
+		Policies:               UploadPolicies,
+		Endpoint:               endpoint,
+		Quotas:                 Quotas,
+		Scan:                   Scan,
+		Audit:                  AuditLog,
+		Storage:                Storage,
+		Drain:                  draining,
+	}
+}
+
+// InitializeWorkerConfig creates and starts the pool of the scheduling strategy of the config.
+func InitializeWorkerConfig(config wp.PoolConfig) error {
+	pool, err := wp.StartPool(config)
+	if err != nil {
+		return err
+	}
+	WorkerPool = pool
+	return nil
 }
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/media_uploader/core"
+	"github.com/media_uploader/tasks"
+)
+
+// draining is closed when the server starts to shut down.
+var draining = make(chan struct{})
+
+var drainOnce sync.Once
+
+// Drain stops accepting new uploads and tells the connected clients to finish their uploads
+// or to reconnect to another server.
+func Drain() {
+	drainOnce.Do(func() {
+		core.LogInfo("Draining, new uploads are refused")
+		close(draining)
+	})
+}
+
+// isDraining reports whether the server is shutting down.
+func isDraining() bool {
+	select {
+	case <-draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// refuseWhileDraining writes a 503 response with the draining message if the server is shutting down,
+// so the client retries on another server. It reports whether the request has been refused.
+func refuseWhileDraining(w http.ResponseWriter) bool {
+	if !isDraining() {
+		return false
+	}
+
+	w.Header().Set("Connection", "close")
+	w.Header().Set("Retry-After", "1")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(tasks.DrainingMessage)
+	return true
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/media_uploader/auth"
+	"github.com/media_uploader/tasks"
+)
+
+// FetchOptions are the limits of server-side fetches.
+var FetchOptions = tasks.FetchOptions{
+	Timeout:      10 * time.Minute,
+	MaxRedirects: 3,
+}
+
+// fetchClient downloads the sources of server-side fetches.
+var fetchClient *http.Client
+
+// InitializeFetch creates the HTTP client of server-side fetches with the current options.
+func InitializeFetch() {
+	fetchClient = tasks.NewFetchClient(FetchOptions)
+}
+
+// Http server-side fetch handler
+func FetchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if refuseWhileDraining(w) {
+		return
+	}
+
+	claims, ok := authenticate(w, r, auth.ScopeUpload)
+	if !ok {
+		return
+	}
+
+	opts := uploadOptions("fetch").WithClaims(claims)
+	release, ok := admitClient(w, r, &opts, true)
+	if !ok {
+		return
+	}
+
+	task := &tasks.FetchUploadTask{
+		Writer:        w,
+		Request:       r,
+		UploadOptions: opts,
+		Fetch:         FetchOptions,
+		Client:        fetchClient,
+		Done:          make(chan struct{}),
+	}
+
+	runTask(r.Context(), task, release)
+
+	// The response is written by the task, so the handler has to wait for it.
+	<-task.Done
+}
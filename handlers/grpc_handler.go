@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/media_uploader/auth"
+	"github.com/media_uploader/core"
+
+	"github.com/media_uploader/tasks"
+	"github.com/media_uploader/uploadpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// authenticatedStream is a server stream whose context carries the claims of the client.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns the context with the claims.
+func (s authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// authenticateStream verifies the bearer token of the "authorization" metadata before the RPC is handled.
+func authenticateStream(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !authenticationEnabled() {
+		return handler(srv, stream)
+	}
+
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return status.Error(codes.Unauthenticated, auth.ErrMissingToken.Error())
+	}
+
+	scheme, token, ok := strings.Cut(values[0], " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return status.Error(codes.Unauthenticated, auth.ErrInvalidToken.Error())
+	}
+
+	claims, err := verifyCredential(token)
+	if err != nil {
+		core.LogWarning(fmt.Sprintf("Unauthenticated RPC %s: %v", info.FullMethod, err))
+		if errors.Is(err, auth.ErrExpiredToken) || errors.Is(err, auth.ErrInvalidKey) {
+			return status.Error(codes.Unauthenticated, err.Error())
+		}
+		return status.Error(codes.Unauthenticated, auth.ErrInvalidToken.Error())
+	}
+
+	// The only RPC is an upload.
+	if !claims.HasScope(auth.ScopeUpload) {
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("scope %q is required", auth.ScopeUpload))
+	}
+
+	return handler(srv, authenticatedStream{ServerStream: stream, ctx: auth.NewContext(stream.Context(), claims)})
+}
+
+// grpcMessageOverhead is the room for the framing of a chunk in a gRPC message.
+const grpcMessageOverhead = 1024
+
+// GrpcUploadServer implements the gRPC upload service on top of the worker pool.
+type GrpcUploadServer struct {
+	uploadpb.UnimplementedUploadServiceServer
+}
+
+// Upload handles the client-streaming Upload RPC.
+func (GrpcUploadServer) Upload(stream uploadpb.UploadService_UploadServer) error {
+	if isDraining() {
+		return status.Error(codes.Unavailable, tasks.DrainingMessage.Error)
+	}
+
+	opts := uploadOptions("upload_grpc").WithClaims(auth.FromContext(stream.Context()))
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		opts.ClientIP = clientIP(p.Addr.String())
+	}
+	opts.ClientKey = clientKey(opts)
+
+	if allowed, retryAfter := ConnectionRate.Allow(opts.ClientKey); !allowed {
+		return throttledStatus(opts.ClientKey, "too many connection attempts", retryAfter)
+	}
+	if !ConcurrentUploads.AcquireUpTo(opts.ClientKey, opts.Claims.MaxConcurrentUploads()) {
+		return throttledStatus(opts.ClientKey, "too many concurrent uploads", ConcurrentUploads.RetryAfter)
+	}
+
+	task := &tasks.GrpcUploadTask{
+		Stream:        stream,
+		UploadOptions: opts,
+		Done:          make(chan error, 1),
+	}
+
+	// The slot is released when the task is done.
+	runTask(stream.Context(), task, func() { ConcurrentUploads.Release(opts.ClientKey) })
+
+	// The stream is only valid until the RPC returns, so the handler has to wait for the task.
+	return <-task.Done
+}
+
+// throttledStatus returns the RESOURCE_EXHAUSTED status of a throttled client
+// with the time after which it may retry.
+func throttledStatus(key, reason string, retryAfter time.Duration) error {
+	core.LogWarning(fmt.Sprintf("Client %s throttled: %s", key, reason))
+
+	st, err := status.New(codes.ResourceExhausted, reason).WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)})
+	if err != nil {
+		return status.Error(codes.ResourceExhausted, reason)
+	}
+	return st.Err()
+}
+
+// NewGrpcServer creates a gRPC server with the upload service and additional options (e.g. TLS credentials).
+// The size of a chunk is limited like the size of a WebSocket message.
+func NewGrpcServer(opts ...grpc.ServerOption) *grpc.Server {
+	maxRecvMsgSize := math.MaxInt32
+	if MaxMessageSize > 0 && MaxMessageSize < math.MaxInt32-grpcMessageOverhead {
+		maxRecvMsgSize = int(MaxMessageSize) + grpcMessageOverhead
+	}
+
+	opts = append(opts, grpc.MaxRecvMsgSize(maxRecvMsgSize), grpc.StreamInterceptor(authenticateStream))
+	server := grpc.NewServer(opts...)
+	uploadpb.RegisterUploadServiceServer(server, GrpcUploadServer{})
+	return server
+}
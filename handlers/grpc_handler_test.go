@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/media_uploader/core"
+	"github.com/media_uploader/ratelimit"
+	"github.com/media_uploader/storage"
+	"github.com/media_uploader/uploadpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newGrpcTestClient serves the upload service over an in-memory connection with a worker pool
+// that cancels the tasks after the task timeout.
+func newGrpcTestClient(t *testing.T, backend *storage.MemoryStorage, taskTimeout time.Duration) (uploadpb.UploadServiceClient, core.Pool) {
+	t.Helper()
+
+	pool, err := core.StartPool(core.PoolConfig{Strategy: core.StrategyPool, Workers: 1, QueueSize: 1, TaskTimeout: taskTimeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPool, oldStorage := WorkerPool, Storage
+	WorkerPool, Storage = pool, backend
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := NewGrpcServer()
+	go server.Serve(listener)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+		server.Stop()
+		pool.Shutdown(context.Background())
+		WorkerPool, Storage = oldPool, oldStorage
+	})
+	return uploadpb.NewUploadServiceClient(conn), pool
+}
+
+// sendUpload opens an upload RPC and sends the metadata and the data of an MP4 file.
+func sendUpload(t *testing.T, client uploadpb.UploadServiceClient, data []byte) uploadpb.UploadService_UploadClient {
+	t.Helper()
+
+	stream, err := client.Upload(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := &uploadpb.UploadMetadata{MimeType: "video/mp4", Size: int64(len(data))}
+	if err := stream.Send(&uploadpb.UploadRequest{Payload: &uploadpb.UploadRequest_Metadata{Metadata: metadata}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&uploadpb.UploadRequest{Payload: &uploadpb.UploadRequest_Chunk{Chunk: data}}); err != nil {
+		t.Fatal(err)
+	}
+	return stream
+}
+
+func TestGrpcUpload(t *testing.T) {
+	backend := storage.NewMemoryStorage()
+	client, _ := newGrpcTestClient(t, backend, time.Minute)
+
+	data := testMP4(2000)
+	response, err := sendUpload(t, client, data).CloseAndRecv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Size != int64(len(data)) || response.Location == "" {
+		t.Errorf("response = %+v, want %d bytes with a location", response, len(data))
+	}
+}
+
+func TestGrpcUploadTaskTimeout(t *testing.T) {
+	// The client has a single upload slot, which the task has to release.
+	oldConcurrency := ConcurrentUploads
+	ConcurrentUploads = ratelimit.NewConcurrency(1, time.Second)
+	t.Cleanup(func() { ConcurrentUploads = oldConcurrency })
+
+	backend := storage.NewMemoryStorage()
+	client, pool := newGrpcTestClient(t, backend, 200*time.Millisecond)
+
+	// The client doesn't close the stream, so the upload waits for more data until the task times out.
+	stream := sendUpload(t, client, testMP4(2000))
+
+	start := time.Now()
+	err := stream.RecvMsg(new(uploadpb.UploadResponse))
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("RPC error = %v, want %s", err, codes.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("RPC returned after %s, want about the task timeout", elapsed)
+	}
+
+	// The worker and the upload slot are free again.
+	deadline := time.Now().Add(2 * time.Second)
+	for pool.Stats().Running > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the cancelled upload still takes a worker")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := sendUpload(t, client, testMP4(1000)).CloseAndRecv(); err != nil {
+		t.Errorf("upload after the timeout: %v", err)
+	}
+}
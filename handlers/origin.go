@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/media_uploader/core"
+)
+
+// AllowedOrigins are the origins that may open WebSocket connections in addition to the own one.
+var AllowedOrigins = &OriginAllowlist{}
+
+// rejectedOrigins counts the WebSocket upgrades that have been rejected because of their origin.
+var rejectedOrigins = expvar.NewInt("websocket_rejected_origins")
+
+// OriginAllowlist decides which origins may open WebSocket connections.
+// Origins are either exact ("https://app.example.com") or wildcards of subdomains ("https://*.example.com").
+type OriginAllowlist struct {
+	// AllowAll allows every origin. It's meant for development only.
+	AllowAll bool
+
+	exact map[string]bool
+	// wildcards are the schemes with the host suffixes (e.g. "https://" and ".example.com").
+	wildcards [][2]string
+}
+
+// ParseOriginAllowlist parses a list of allowed origins.
+func ParseOriginAllowlist(origins []string) (*OriginAllowlist, error) {
+	allowlist := &OriginAllowlist{exact: make(map[string]bool)}
+
+	for _, origin := range origins {
+		origin = strings.ToLower(strings.TrimRight(strings.TrimSpace(origin), "/"))
+		if origin == "" {
+			continue
+		}
+
+		scheme, host, ok := strings.Cut(origin, "://")
+		if !ok || scheme == "" || host == "" || strings.ContainsAny(host, "/?#") {
+			return nil, fmt.Errorf("invalid origin: %q", origin)
+		}
+
+		if suffix, ok := strings.CutPrefix(host, "*"); ok {
+			if !strings.HasPrefix(suffix, ".") || strings.Contains(suffix, "*") {
+				return nil, fmt.Errorf("invalid wildcard origin: %q", origin)
+			}
+			allowlist.wildcards = append(allowlist.wildcards, [2]string{scheme + "://", suffix})
+			continue
+		}
+		if strings.Contains(host, "*") {
+			return nil, fmt.Errorf("invalid wildcard origin: %q", origin)
+		}
+
+		allowlist.exact[origin] = true
+	}
+
+	return allowlist, nil
+}
+
+// LoadOriginAllowlist loads the allowed origins of an environment from a JSON file
+// that maps the environments to their origins, e.g. {"production": ["https://app.example.com"]}.
+func LoadOriginAllowlist(path, environment string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var environments map[string][]string
+	if err := json.Unmarshal(data, &environments); err != nil {
+		return nil, fmt.Errorf("invalid origins file %s: %w", path, err)
+	}
+
+	origins, ok := environments[environment]
+	if !ok {
+		return nil, fmt.Errorf("origins file %s has no environment %q", path, environment)
+	}
+	return origins, nil
+}
+
+// allowed reports whether the origin is in the allowlist.
+func (a *OriginAllowlist) allowed(origin string) bool {
+	if a.AllowAll {
+		return true
+	}
+
+	origin = strings.ToLower(origin)
+	if a.exact[origin] {
+		return true
+	}
+
+	for _, wildcard := range a.wildcards {
+		host, ok := strings.CutPrefix(origin, wildcard[0])
+		if ok && len(host) > len(wildcard[1]) && strings.HasSuffix(host, wildcard[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin is the origin check of the WebSocket upgrades. Requests without an Origin header
+// (non-browser clients) and same-origin requests are allowed, other origins have to be in the allowlist.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	if AllowedOrigins.allowed(origin) {
+		return true
+	}
+
+	rejectedOrigins.Add(1)
+	core.LogWarning(fmt.Sprintf("WebSocket upgrade rejected for origin %q from %s", origin, r.RemoteAddr))
+	return false
+}
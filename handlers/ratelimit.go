@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/media_uploader/core"
+	"github.com/media_uploader/ratelimit"
+	"github.com/media_uploader/tasks"
+)
+
+// ConnectionRate limits the connection attempts (upload requests) per client, nil for unlimited.
+var ConnectionRate *ratelimit.Limiter
+
+// ByteRate limits the received bytes per second per client, nil for unlimited.
+var ByteRate *ratelimit.Limiter
+
+// ConcurrentUploads caps the concurrent uploads per client, nil for unlimited.
+var ConcurrentUploads *ratelimit.Concurrency
+
+// clientIP returns the IP address of a remote address.
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// clientKey returns the key of the client for rate limiting: the API key, the subject of its token or ticket,
+// or its IP address.
+func clientKey(opts tasks.UploadOptions) string {
+	if opts.Claims != nil && opts.Claims.Key != nil {
+		return opts.Claims.Subject
+	}
+	if opts.Claims != nil && opts.Claims.Subject != "" {
+		return "sub:" + opts.Claims.Subject
+	}
+	if opts.Ticket != nil && opts.Ticket.Subject != "" {
+		return "sub:" + opts.Ticket.Subject
+	}
+
+	return "ip:" + opts.ClientIP
+}
+
+// admitClient applies the rate limits of the client to a new connection. For a single upload, a slot of the
+// concurrent uploads is taken, which has to be released by calling release when the upload is done.
+// A 429 response with the time after which the client may retry is written if the client is throttled.
+func admitClient(w http.ResponseWriter, r *http.Request, opts *tasks.UploadOptions, singleUpload bool) (release func(), ok bool) {
+	opts.ClientIP = clientIP(r.RemoteAddr)
+	opts.ClientKey = clientKey(*opts)
+
+	if allowed, retryAfter := ConnectionRate.Allow(opts.ClientKey); !allowed {
+		throttled(w, opts.ClientKey, "too many connection attempts", retryAfter)
+		return nil, false
+	}
+
+	if !singleUpload {
+		return func() {}, true
+	}
+
+	if !ConcurrentUploads.AcquireUpTo(opts.ClientKey, opts.Claims.MaxConcurrentUploads()) {
+		throttled(w, opts.ClientKey, "too many concurrent uploads", ConcurrentUploads.RetryAfter)
+		return nil, false
+	}
+	return func() { ConcurrentUploads.Release(opts.ClientKey) }, true
+}
+
+// throttled writes a 429 response with the Retry-After header and a "throttled" message.
+func throttled(w http.ResponseWriter, key, reason string, retryAfter time.Duration) {
+	core.LogWarning(fmt.Sprintf("Client %s throttled: %s", key, reason))
+
+	msg := tasks.ThrottledMessage(0, reason, retryAfter)
+	w.Header().Set("Retry-After", strconv.FormatInt(msg.RetryAfter, 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(msg)
+}
+
+// releasingTask releases the upload slot of the client when the task is done.
+type releasingTask struct {
+	core.Task
+	release func()
+}
+
+// Execute executes the task and releases the slot afterwards.
+func (t releasingTask) Execute() error {
+	defer t.release()
+	return t.Task.Execute()
+}
+
+// ExecuteContext executes the task with a context and releases the slot afterwards.
+func (t releasingTask) ExecuteContext(ctx context.Context) error {
+	defer t.release()
+	return core.WithContext(t.Task).ExecuteContext(ctx)
+}
@@ -1,27 +1,54 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 
+	"github.com/gorilla/websocket"
+	"github.com/media_uploader/auth"
 	tasks "github.com/media_uploader/tasks"
 )
 
 // Http stream handler
 func StreamHandler(w http.ResponseWriter, r *http.Request) {
+	if refuseWhileDraining(w) {
+		return
+	}
+
+	opts, ok := authorizeUpload(w, r, "upload_stream")
+	if !ok {
+		return
+	}
+
+	release, ok := admitClient(w, r, &opts, true)
+	if !ok {
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 
 	if err != nil {
+		release()
 		fmt.Println(err)
 		return
 	}
 
+	// The ticket is redeemed by the upgraded connection, the response has been sent already.
+	if err := redeemTicket(r, opts); err != nil {
+		release()
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()))
+		conn.Close()
+		return
+	}
+
 	task := &tasks.StreamUploadTask{
-		Conn:                   conn,
-		SaveUploadsTemporarily: SaveUploadsTemporarily,
+		Conn:          conn,
+		UploadOptions: opts,
 	}
 
-	WorkerPool.Run(task)
+	// The request ends with the upgrade, the task ends with the connection.
+	runTask(context.Background(), task, release)
 
 	// fligramTask := &tasks.FligramStamp{
 	// 	Image: "Somethin which is not fligram",
@@ -29,3 +56,78 @@ func StreamHandler(w http.ResponseWriter, r *http.Request) {
 
 	// WorkerPool.Run(fligramTask)
 }
+
+// Http multiplexed stream handler
+func MuxStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if refuseWhileDraining(w) {
+		return
+	}
+
+	claims, ok := authenticate(w, r, auth.ScopeUpload)
+	if !ok {
+		return
+	}
+
+	// The concurrent uploads are capped per stream by the task.
+	opts := uploadOptions("upload_mux").WithClaims(claims)
+	release, ok := admitClient(w, r, &opts, false)
+	if !ok {
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	task := &tasks.MuxUploadTask{
+		Conn:          conn,
+		UploadOptions: opts,
+		MaxStreams:    MaxStreamsPerConn,
+	}
+
+	runTask(context.Background(), task, release)
+}
+
+// Http multipart/form-data upload handler
+func FormUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if refuseWhileDraining(w) {
+		return
+	}
+
+	opts, ok := authorizeUpload(w, r, "upload")
+	if !ok {
+		return
+	}
+
+	release, ok := admitClient(w, r, &opts, true)
+	if !ok {
+		return
+	}
+
+	if err := redeemTicket(r, opts); err != nil {
+		release()
+		unauthorized(w, err.Error())
+		return
+	}
+
+	task := &tasks.FormUploadTask{
+		Writer:        w,
+		Request:       r,
+		UploadOptions: opts,
+		Done:          make(chan struct{}),
+	}
+
+	runTask(r.Context(), task, release)
+
+	// The response is written by the task, so the handler has to wait for it.
+	<-task.Done
+}
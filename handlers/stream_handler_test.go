@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/media_uploader/storage"
+	"github.com/media_uploader/tasks"
+)
+
+func TestStreamRejectsNegativeSize(t *testing.T) {
+	server := newTestServer(t, storage.NewMemoryStorage())
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/upload_stream"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteJSON(tasks.FirstChunk{Video: true, MimeType: "video/mp4", Size: -1}); err != nil {
+		t.Fatal(err)
+	}
+
+	var message tasks.ServerMessage
+	if err := conn.ReadJSON(&message); err != nil || message.Type != "error" || !strings.Contains(message.Error, "invalid size") {
+		t.Errorf("first message = %+v, %v, want an invalid size error", message, err)
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseUnsupportedData) {
+		t.Errorf("close = %v, want close code %d", err, websocket.CloseUnsupportedData)
+	}
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/media_uploader/auth"
+	"github.com/media_uploader/core"
+)
+
+// TicketQueryParameter is the query parameter that carries an upload ticket.
+// WebSocket clients in browsers can't set the TicketHeader.
+const TicketQueryParameter = "ticket"
+
+// TicketHeader is the header that carries an upload ticket.
+const TicketHeader = "X-Upload-Ticket"
+
+// Tickets issues and redeems the upload tickets, nil disables them.
+var Tickets *auth.Tickets
+
+// RequireTickets requires an upload ticket for the uploads that accept tickets.
+var RequireTickets = false
+
+// TicketMaxTTL is the maximum lifetime of an issued ticket.
+var TicketMaxTTL = time.Hour
+
+// defaultTicketTTL is the lifetime of an issued ticket if the request doesn't specify one.
+const defaultTicketTTL = 15 * time.Minute
+
+// InitializeTickets enables upload tickets signed with the secret.
+func InitializeTickets(secret string, maxTTL time.Duration) {
+	if secret == "" {
+		return
+	}
+	Tickets = auth.NewTickets([]byte(secret))
+	TicketMaxTTL = maxTTL
+}
+
+// ticketRequest is the body of a ticket request.
+type ticketRequest struct {
+	Types   []string `json:"types"`
+	MaxSize int64    `json:"maxSize"`
+	MediaId string   `json:"mediaId"`
+	Prefix  string   `json:"prefix"`
+	// ExpiresIn is the lifetime of the ticket in seconds.
+	ExpiresIn int64 `json:"expiresIn"`
+}
+
+// ticketResponse is the body of an issued ticket.
+type ticketResponse struct {
+	Ticket    string `json:"ticket"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// ticketFromRequest returns the upload ticket of a request, empty if there is none.
+func ticketFromRequest(r *http.Request) string {
+	if ticket := r.Header.Get(TicketHeader); ticket != "" {
+		return ticket
+	}
+	return r.URL.Query().Get(TicketQueryParameter)
+}
+
+// Http upload ticket handler. Tickets are issued to authenticated clients only,
+// for the subject and the tenant of their token or API key.
+func TicketHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if Tickets == nil {
+		http.Error(w, "upload tickets are disabled", http.StatusNotFound)
+		return
+	}
+	if !authenticationEnabled() {
+		http.Error(w, "issuing tickets requires authentication", http.StatusForbidden)
+		return
+	}
+
+	claims, ok := authenticate(w, r, auth.ScopeUpload)
+	if !ok {
+		return
+	}
+
+	var request ticketRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&request); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if request.MaxSize < 0 {
+		http.Error(w, "invalid maxSize", http.StatusBadRequest)
+		return
+	}
+
+	// The tickets of an API key can't exceed the restrictions of the key.
+	if key := claims.Key; key != nil {
+		if request.MediaId != "" && !strings.HasPrefix(request.MediaId, key.Prefix) {
+			forbidden(w, fmt.Sprintf("media id has to start with %q", key.Prefix))
+			return
+		}
+		request.Prefix = key.Prefix + request.Prefix
+		if key.MaxSize > 0 && (request.MaxSize == 0 || request.MaxSize > key.MaxSize) {
+			request.MaxSize = key.MaxSize
+		}
+	}
+
+	ttl := defaultTicketTTL
+	if request.ExpiresIn > 0 {
+		ttl = time.Duration(request.ExpiresIn) * time.Second
+	}
+	ttl = min(ttl, TicketMaxTTL)
+	expiresAt := time.Now().Add(ttl).Unix()
+
+	ticket, err := Tickets.Issue(auth.Ticket{
+		AllowedTypes: request.Types,
+		MaxSize:      request.MaxSize,
+		MediaId:      request.MediaId,
+		Prefix:       request.Prefix,
+		Subject:      claims.Subject,
+		Tenant:       claims.Tenant,
+		ExpiresAt:    expiresAt,
+	})
+	if err != nil {
+		core.LogError("Error (while issuing ticket)", err)
+		http.Error(w, "failed to issue ticket", http.StatusInternalServerError)
+		return
+	}
+
+	core.LogInfo(fmt.Sprintf("Issued upload ticket for %q", claims.Subject))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ticketResponse{Ticket: ticket, ExpiresAt: expiresAt})
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/media_uploader/auth"
+	"github.com/media_uploader/tasks"
+)
+
+// tusBasePath is the URL path of the tus uploads.
+const tusBasePath = "/files/"
+
+// TusStore keeps the state of the tus uploads.
+var TusStore *tasks.TusStore
+
+// InitializeTus initializes the tus store. Idle uploads are aborted after the expiration.
+func InitializeTus(expiration time.Duration) {
+	TusStore = tasks.NewTusStore(uploadOptions("tus"), tusBasePath, expiration)
+}
+
+// tusScope returns the scope of a tus request: HEAD reads an upload, DELETE deletes it
+// and the other methods upload.
+func tusScope(method string) string {
+	switch method {
+	case http.MethodHead:
+		return auth.ScopeRead
+	case http.MethodDelete:
+		return auth.ScopeDelete
+	}
+	return auth.ScopeUpload
+}
+
+// Http tus resumable upload handler
+func TusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tasks.TusVersion)
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Upload-Offset, Upload-Length, Tus-Resumable, X-Media-Id, X-Media-Location")
+
+	method := r.Method
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" {
+		method = override
+	}
+
+	if method == http.MethodOptions {
+		TusStore.Options(w, r)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tasks.TusVersion {
+		w.Header().Set("Tus-Version", tasks.TusVersion)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	claims, ok := authenticate(w, r, tusScope(method))
+	if !ok {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, tusBasePath)
+	if id == "" && method != http.MethodPost {
+		w.Header().Set("Allow", "OPTIONS, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Every PATCH request is an upload in progress.
+	opts := TusStore.UploadOptions.WithClaims(claims)
+	release, ok := admitClient(w, r, &opts, method == http.MethodPatch)
+	if !ok {
+		return
+	}
+
+	if id == "" {
+		// Uploads in progress may be finished, but no new ones are created.
+		if refuseWhileDraining(w) {
+			return
+		}
+		TusStore.Create(w, r, opts)
+		return
+	}
+
+	switch method {
+	case http.MethodHead:
+		TusStore.Head(w, r, id, claims)
+	case http.MethodPatch:
+		task := &tasks.TusPatchTask{
+			Store:   TusStore,
+			Id:      id,
+			Writer:  w,
+			Request: r,
+			Claims:  claims,
+			Done:    make(chan struct{}),
+		}
+
+		runTask(r.Context(), task, release)
+
+		// The response is written by the task, so the handler has to wait for it.
+		<-task.Done
+	case http.MethodDelete:
+		TusStore.Terminate(w, r, id, claims)
+	default:
+		w.Header().Set("Allow", "OPTIONS, HEAD, PATCH, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,432 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	uploader "github.com/media_uploader/amazon"
+	"github.com/media_uploader/core"
+	"github.com/media_uploader/ratelimit"
+	"github.com/media_uploader/storage"
+	"github.com/media_uploader/tasks"
+)
+
+func TestMain(m *testing.M) {
+	// The logger writes to logs/app.log in the working directory.
+	dir, err := os.MkdirTemp("", "handlers-test-*")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	core.InitializeLogger()
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newTestServer serves the upload endpoints with the given storage and a small worker pool.
+// Clients may choose their media ids.
+func newTestServer(t *testing.T, backend *storage.MemoryStorage) *httptest.Server {
+	t.Helper()
+
+	pool, err := core.StartPool(core.PoolConfig{Strategy: core.StrategyPool, Workers: 4, QueueSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldPool, oldStorage, oldAllow := WorkerPool, Storage, AllowClientMediaId
+	WorkerPool, Storage, AllowClientMediaId = pool, backend, true
+	InitializeTus(time.Hour)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload_stream", StreamHandler)
+	mux.HandleFunc("/upload", FormUploadHandler)
+	mux.HandleFunc(tusBasePath, TusHandler)
+	server := httptest.NewServer(mux)
+
+	t.Cleanup(func() {
+		server.Close()
+		pool.Shutdown(context.Background())
+		WorkerPool, Storage, AllowClientMediaId = oldPool, oldStorage, oldAllow
+	})
+	return server
+}
+
+// testMP4 returns data that is detected as video/mp4.
+func testMP4(size int) []byte {
+	data := bytes.Repeat([]byte{0x42}, size)
+	copy(data, []byte("\x00\x00\x00\x20ftypisom"))
+	return data
+}
+
+// tusRequest sends a tus request with the Tus-Resumable header.
+func tusRequest(t *testing.T, method, url string, body []byte, headers map[string]string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Tus-Resumable", tasks.TusVersion)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+// tusCreate creates a tus upload of an MP4 file and returns its URL.
+func tusCreate(t *testing.T, server *httptest.Server, length int, mediaId string) string {
+	t.Helper()
+
+	metadata := "filetype " + base64.StdEncoding.EncodeToString([]byte("video/mp4"))
+	if mediaId != "" {
+		metadata += ",mediaId " + base64.StdEncoding.EncodeToString([]byte(mediaId))
+	}
+
+	resp := tusRequest(t, http.MethodPost, server.URL+tusBasePath, nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": metadata,
+	})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST status = %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, tusBasePath) {
+		t.Fatalf("Location = %q, want a path below %s", location, tusBasePath)
+	}
+	if resp.Header.Get("Upload-Offset") != "0" {
+		t.Errorf("Upload-Offset = %q, want 0", resp.Header.Get("Upload-Offset"))
+	}
+	return server.URL + location
+}
+
+// tusPatch appends data to a tus upload.
+func tusPatch(t *testing.T, url string, offset int, data []byte, headers map[string]string) *http.Response {
+	t.Helper()
+
+	patchHeaders := map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	}
+	for name, value := range headers {
+		patchHeaders[name] = value
+	}
+	return tusRequest(t, http.MethodPatch, url, data, patchHeaders)
+}
+
+// assertOffset checks the offset of a tus upload.
+func assertOffset(t *testing.T, url string, offset int) {
+	t.Helper()
+
+	resp := tusRequest(t, http.MethodHead, url, nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("HEAD status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := resp.Header.Get("Upload-Offset"); got != strconv.Itoa(offset) {
+		t.Errorf("Upload-Offset = %s, want %d", got, offset)
+	}
+}
+
+func sha1Checksum(data []byte) string {
+	sum := sha1.Sum(data)
+	return "sha1 " + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestTusOptions(t *testing.T) {
+	server := newTestServer(t, storage.NewMemoryStorage())
+
+	resp := tusRequest(t, http.MethodOptions, server.URL+tusBasePath, nil, nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("OPTIONS status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+
+	for name, want := range map[string]string{
+		"Tus-Resumable":          tasks.TusVersion,
+		"Tus-Version":            tasks.TusVersion,
+		"Tus-Extension":          tasks.TusExtensions,
+		"Tus-Checksum-Algorithm": tasks.TusChecksumAlgorithms,
+	} {
+		if got := resp.Header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestTusUpload(t *testing.T) {
+	backend := storage.NewMemoryStorage()
+	server := newTestServer(t, backend)
+
+	data := testMP4(3000)
+	url := tusCreate(t, server, len(data), "")
+	assertOffset(t, url, 0)
+
+	resp := tusPatch(t, url, 0, data[:1000], nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("PATCH status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	if resp.Header.Get("Upload-Offset") != "1000" {
+		t.Errorf("Upload-Offset = %q, want 1000", resp.Header.Get("Upload-Offset"))
+	}
+	assertOffset(t, url, 1000)
+
+	// The offset has to match the offset of the upload.
+	resp = tusPatch(t, url, 0, data[:1000], nil)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("PATCH with a stale offset: status = %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+	assertOffset(t, url, 1000)
+
+	// A body that doesn't match its checksum is discarded.
+	resp = tusPatch(t, url, 1000, data[1000:2000], map[string]string{"Upload-Checksum": sha1Checksum(data[:1000])})
+	if resp.StatusCode != 460 {
+		t.Errorf("PATCH with a wrong checksum: status = %d, want 460", resp.StatusCode)
+	}
+	assertOffset(t, url, 1000)
+
+	resp = tusPatch(t, url, 1000, data[1000:], map[string]string{"Upload-Checksum": sha1Checksum(data[1000:])})
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("last PATCH status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	if resp.Header.Get("Upload-Offset") != "3000" {
+		t.Errorf("Upload-Offset = %q, want 3000", resp.Header.Get("Upload-Offset"))
+	}
+
+	location := resp.Header.Get("X-Media-Location")
+	if location == "" {
+		t.Fatal("completed upload has no X-Media-Location")
+	}
+	key := uploader.ObjectKey(path.Base(location))
+	object, ok := backend.Object(key)
+	if !ok {
+		t.Fatalf("object %s has not been stored", key)
+	}
+	if object.ContentType != "video/mp4" || !bytes.Equal(object.Data, data) {
+		t.Errorf("stored %s with %d bytes, want video/mp4 with %d bytes", object.ContentType, len(object.Data), len(data))
+	}
+
+	// A completed upload doesn't take more data.
+	resp = tusPatch(t, url, 3000, []byte{0}, nil)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("PATCH of a completed upload: status = %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+}
+
+func TestTusCorrectedTypeSizeLimit(t *testing.T) {
+	oldLimits := UploadLimits
+	UploadLimits = tasks.SizeLimits{ByMimeType: map[string]int64{"image/*": 1 << 20, "video/*": 2000}}
+	t.Cleanup(func() { UploadLimits = oldLimits })
+
+	backend := storage.NewMemoryStorage()
+	server := newTestServer(t, backend)
+
+	tests := []struct {
+		name   string
+		size   int
+		status int
+	}{
+		{"within the limit of the detected type", 2000, http.StatusNoContent},
+		{"above the limit of the detected type", 3000, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The upload is declared as an image, but its content is detected as video/mp4.
+			resp := tusRequest(t, http.MethodPost, server.URL+tusBasePath, nil, map[string]string{
+				"Upload-Length":   strconv.Itoa(tt.size),
+				"Upload-Metadata": "filetype " + base64.StdEncoding.EncodeToString([]byte("image/png")),
+			})
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("POST status = %d, want %d", resp.StatusCode, http.StatusCreated)
+			}
+
+			url := server.URL + resp.Header.Get("Location")
+			resp = tusPatch(t, url, 0, testMP4(tt.size), nil)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("PATCH status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status != http.StatusNoContent {
+				// The rejected upload can't be resumed.
+				if resp := tusRequest(t, http.MethodHead, url, nil, nil); resp.StatusCode != http.StatusNotFound {
+					t.Errorf("HEAD after the rejection: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+				}
+			}
+			if location := resp.Header.Get("X-Media-Location"); tt.status == http.StatusNoContent {
+				object, ok := backend.Object(uploader.ObjectKey(path.Base(location)))
+				if !ok || object.ContentType != "video/mp4" {
+					t.Errorf("stored %s as %q, want video/mp4", location, object.ContentType)
+				}
+			}
+		})
+	}
+}
+
+func TestTusRejectedUploadCantBeResumed(t *testing.T) {
+	oldPolicy := TypePolicy
+	TypePolicy = tasks.TypePolicyReject
+	t.Cleanup(func() { TypePolicy = oldPolicy })
+
+	backend := storage.NewMemoryStorage()
+	server := newTestServer(t, backend)
+
+	// The upload is declared as an image, but its content is detected as video/mp4.
+	data := testMP4(3000)
+	resp := tusRequest(t, http.MethodPost, server.URL+tusBasePath, nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(len(data)),
+		"Upload-Metadata": "filetype " + base64.StdEncoding.EncodeToString([]byte("image/png")),
+	})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST status = %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+	url := server.URL + resp.Header.Get("Location")
+
+	if resp := tusPatch(t, url, 0, data[:1000], nil); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("PATCH status = %d, want %d", resp.StatusCode, http.StatusUnsupportedMediaType)
+	}
+	if resp := tusRequest(t, http.MethodHead, url, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("HEAD after the rejection: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	if resp := tusPatch(t, url, 1000, data[1000:], nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("PATCH after the rejection: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	for _, name := range []string{path.Base(url) + ".png", path.Base(url) + ".mp4"} {
+		if _, ok := backend.Object(uploader.ObjectKey(name)); ok {
+			t.Errorf("object %s has been stored", name)
+		}
+	}
+}
+
+func TestTusTerminate(t *testing.T) {
+	server := newTestServer(t, storage.NewMemoryStorage())
+
+	data := testMP4(2000)
+	url := tusCreate(t, server, len(data), "")
+	if resp := tusPatch(t, url, 0, data[:1000], nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("PATCH status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+
+	resp := tusRequest(t, http.MethodDelete, url, nil, nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+
+	for _, method := range []string{http.MethodHead, http.MethodDelete} {
+		if resp := tusRequest(t, method, url, nil, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s after DELETE: status = %d, want %d", method, resp.StatusCode, http.StatusNotFound)
+		}
+	}
+	if resp := tusPatch(t, url, 1000, data[1000:], nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("PATCH after DELETE: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestTusRequiresVersion(t *testing.T) {
+	server := newTestServer(t, storage.NewMemoryStorage())
+
+	resp, err := http.Post(server.URL+tusBasePath, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("POST without Tus-Resumable: status = %d, want %d", resp.StatusCode, http.StatusPreconditionFailed)
+	}
+}
+
+// streamUpload uploads data over the WebSocket endpoint and returns the location of the file.
+func streamUpload(t *testing.T, server *httptest.Server, data []byte, mediaId string) string {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/upload_stream"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	first := tasks.FirstChunk{Video: true, MimeType: "video/mp4", MediaId: mediaId, Size: int64(len(data))}
+	if err := conn.WriteJSON(first); err != nil {
+		t.Fatal(err)
+	}
+
+	var accepted tasks.ServerMessage
+	if err := conn.ReadJSON(&accepted); err != nil || accepted.Type != "accepted" {
+		t.Fatalf("first message = %+v, %v, want accepted", accepted, err)
+	}
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("EOF")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, location, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(location)
+}
+
+func TestTusLocationMatchesStream(t *testing.T) {
+	data := testMP4(1500)
+
+	server := newTestServer(t, storage.NewMemoryStorage())
+	url := tusCreate(t, server, len(data), "same-media")
+	resp := tusPatch(t, url, 0, data, nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("PATCH status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	tusLocation := resp.Header.Get("X-Media-Location")
+
+	// The same media id is uploaded to another storage, since uploads never overwrite an object.
+	Storage = storage.NewMemoryStorage()
+	streamLocation := streamUpload(t, server, data, "same-media")
+
+	if tusLocation == "" || tusLocation != streamLocation {
+		t.Errorf("tus location = %q, WebSocket location = %q, want the same", tusLocation, streamLocation)
+	}
+}
+
+func TestTusPatchWithoutIdKeepsUploadSlot(t *testing.T) {
+	server := newTestServer(t, storage.NewMemoryStorage())
+
+	oldConcurrency := ConcurrentUploads
+	ConcurrentUploads = ratelimit.NewConcurrency(1, time.Second)
+	t.Cleanup(func() { ConcurrentUploads = oldConcurrency })
+
+	for i := 0; i < 3; i++ {
+		resp := tusPatch(t, server.URL+tusBasePath, 0, []byte{0}, nil)
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Fatalf("PATCH without id: status = %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+		}
+	}
+
+	// The only upload slot of the client is still free.
+	data := testMP4(1000)
+	url := tusCreate(t, server, len(data), "")
+	if resp := tusPatch(t, url, 0, data, nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("PATCH status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+}
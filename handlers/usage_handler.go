@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/media_uploader/auth"
+	"github.com/media_uploader/core"
+	"github.com/media_uploader/quota"
+)
+
+// Quotas are the storage quotas and the usage of the tenants, nil disables the accounting.
+var Quotas *quota.Quotas
+
+// InitializeQuotas enables the usage accounting in the ledger file (in memory if the path is empty)
+// with the quotas of the config.
+func InitializeQuotas(ledgerPath string, config quota.Config) error {
+	var ledger quota.Ledger = quota.NewMemoryLedger()
+	if ledgerPath != "" {
+		fileLedger, err := quota.OpenFileLedger(ledgerPath)
+		if err != nil {
+			return err
+		}
+		ledger = fileLedger
+	}
+
+	Quotas = quota.NewQuotas(ledger, config)
+	return nil
+}
+
+// Http usage handler. Authenticated clients get the usage of their tenant. Without authentication,
+// the usage of the tenant of the "tenant" query parameter or of every tenant is returned.
+func UsageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if Quotas == nil {
+		http.Error(w, "usage accounting is disabled", http.StatusNotFound)
+		return
+	}
+
+	tenant := r.URL.Query().Get("tenant")
+	if authenticationEnabled() {
+		claims, ok := authenticate(w, r, auth.ScopeRead)
+		if !ok {
+			return
+		}
+		if claims.Tenant == "" || (tenant != "" && tenant != claims.Tenant) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		tenant = claims.Tenant
+	}
+
+	var body any
+	var err error
+	if tenant != "" {
+		body, err = Quotas.Usage(tenant)
+	} else {
+		body, err = Quotas.Usages()
+	}
+	if err != nil {
+		core.LogError("Error (while reading usage)", err)
+		http.Error(w, "failed to read usage", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(body)
+}
@@ -1,14 +1,31 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/media_uploader/audit"
+	"github.com/media_uploader/certs"
 	"github.com/media_uploader/core"
 	handlers "github.com/media_uploader/handlers"
+	"github.com/media_uploader/quota"
+	"github.com/media_uploader/ratelimit"
+	"github.com/media_uploader/scan"
+	"github.com/media_uploader/storage"
+	"github.com/media_uploader/tasks"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 var (
@@ -16,26 +33,163 @@ var (
 	perf                      = flag.Bool("perf", false, "Enable performance testing")
 	workers                   = flag.Int("workers", 10, "Number of workers")
 	chBufferSize              = flag.Int("chBufferSize", 100, "Channel buffer size")
-	workerMemoryLimit         = flag.Uint64("workerMemoryLimit", 75, "Worker memory limit")
-	useSpawnerWithMemoryLimit = flag.Bool("useSpawnerWithMemoryLimit", true, "Use worker spawner with memory limit")
+	queueTimeout              = flag.Duration("queueTimeout", 0, "How long an upload waits for room in the worker queue, 0 to reject it at once, negative to wait indefinitely")
+	taskTimeout               = flag.Duration("taskTimeout", 0, "Maximum duration of an upload task, after which it is cancelled, 0 for unlimited")
+	workerMemoryLimit         = flag.Uint64("workerMemoryLimit", 75, "Memory usage in percent of the memory budget above which tasks are rejected")
+	workerMemoryResume        = flag.Uint64("workerMemoryResume", 65, "Memory usage in percent of the memory budget below which tasks are admitted again")
+	workerMemoryBudget        = flag.String("workerMemoryBudget", "0", "Memory budget of the process (e.g. 2GB), 0 for the memory limit of the cgroup")
+	scheduler                 = flag.String("scheduler", core.StrategySpawner, "Scheduling strategy of the uploads (pool, spawner, hybrid)")
+	useSpawnerWithMemoryLimit = flag.Bool("useSpawnerWithMemoryLimit", true, "Deprecated: use -scheduler spawner or -scheduler pool")
 	enableSimpleInterface     = flag.Bool("enableSimpleInterface", false, "Enable simple interface to upload files")
 	saveUploadsTemporarily    = flag.Bool("saveUploadsTemporarily", false, "Save uploaded files temporarily")
+	maxStreamsPerConn         = flag.Int("maxStreamsPerConn", 8, "Maximum number of concurrent uploads on one multiplexed connection")
+	allowClientMediaId        = flag.Bool("allowClientMediaId", false, "Allow clients to choose the media ids of their uploads")
+	maxUploadSize             = flag.String("maxUploadSize", "0", "Maximum upload size (e.g. 2GB), 0 for unlimited")
+	maxUploadSizeByMime       = flag.String("maxUploadSizeByMime", "", "Maximum upload sizes per MIME type (e.g. video/*=2GB,image/*=20MB)")
+	typePolicy                = flag.String("typePolicy", "correct", "What to do if the content doesn't match the declared MIME type (reject, correct, trust)")
+	policyFile                = flag.String("policyFile", "", "Path of the JSON file with the upload policies")
+	storageBackend            = flag.String("storage", "r2", "Storage of the uploaded files (r2, memory)")
+	tusExpiration             = flag.Duration("tusExpiration", 24*time.Hour, "Time after which an idle tus upload is aborted")
+	maxMessageSize            = flag.String("maxMessageSize", "8MB", "Maximum size of a single WebSocket message, 0 for unlimited")
+	wsPingInterval            = flag.Duration("wsPingInterval", 30*time.Second, "Interval of the WebSocket pings, 0 to disable")
+	wsPongTimeout             = flag.Duration("wsPongTimeout", 10*time.Second, "Time a WebSocket client has to answer a ping")
+	wsReadTimeout             = flag.Duration("wsReadTimeout", 60*time.Second, "Maximum time between two WebSocket messages, 0 for unlimited")
+	wsMaxDuration             = flag.Duration("wsMaxDuration", 0, "Maximum duration of a WebSocket connection, 0 for unlimited")
+	fetchTimeout              = flag.Duration("fetchTimeout", 10*time.Minute, "Maximum duration of a server-side fetch, 0 for unlimited")
+	fetchMaxRedirects         = flag.Int("fetchMaxRedirects", 3, "Maximum number of redirects of a server-side fetch")
+	fetchMaxSize              = flag.String("fetchMaxSize", "0", "Maximum size of a server-side fetch (e.g. 2GB), 0 for unlimited")
+	fetchAllowPrivateNetworks = flag.Bool("fetchAllowPrivateNetworks", false, "Allow server-side fetches from private networks (development only)")
+	jwtSecret                 = flag.String("jwtSecret", "", "Shared secret of HS256 tokens, enables authentication")
+	jwks                      = flag.String("jwks", "", "Path or URL of the JWKS with the keys of RS256/ES256 tokens, enables authentication")
+	jwtIssuer                 = flag.String("jwtIssuer", "", "Required issuer of the tokens")
+	jwtAudience               = flag.String("jwtAudience", "", "Required audience of the tokens")
+	jwtTenantClaim            = flag.String("jwtTenantClaim", "tenant", "Claim of the tokens that holds the tenant of the client")
+	apiKeys                   = flag.String("apiKeys", "", "Path of the JSON file with the hashed API keys, enables API keys")
+	ticketSecret              = flag.String("ticketSecret", "", "Secret of the upload ticket signatures, enables upload tickets")
+	ticketMaxTTL              = flag.Duration("ticketMaxTTL", time.Hour, "Maximum lifetime of an upload ticket")
+	requireTickets            = flag.Bool("requireTickets", false, "Require an upload ticket for /upload_stream and /upload")
+	allowedOrigins            = flag.String("allowedOrigins", "", "Origins that may open WebSocket connections (e.g. https://app.example.com,https://*.example.com)")
+	originsFile               = flag.String("originsFile", "", "Path of the JSON file with the allowed origins per environment")
+	environment               = flag.String("environment", "production", "Environment of the allowed origins in the origins file")
+	allowAllOrigins           = flag.Bool("allowAllOrigins", false, "Allow WebSocket connections from every origin (development only)")
+	connectionRate            = flag.Float64("connectionRate", 0, "Connection attempts per second and client, 0 for unlimited")
+	connectionBurst           = flag.Int("connectionBurst", 10, "Burst of connection attempts per client")
+	uploadByteRate            = flag.String("uploadByteRate", "0", "Upload bandwidth per client and second (e.g. 10MB), 0 for unlimited")
+	uploadByteBurst           = flag.String("uploadByteBurst", "0", "Burst of the upload bandwidth per client (e.g. 32MB)")
+	maxConcurrentUploads      = flag.Int("maxConcurrentUploads", 0, "Maximum number of concurrent uploads per client, 0 for unlimited")
+	quotaFile                 = flag.String("quotaFile", "", "Path of the JSON file with the storage quotas of the tenants")
+	tenantMaxBytes            = flag.String("tenantMaxBytes", "0", "Default storage quota of a tenant (e.g. 100GB), 0 for unlimited")
+	tenantMaxObjects          = flag.Int64("tenantMaxObjects", 0, "Default maximum number of objects of a tenant, 0 for unlimited")
+	usageLedger               = flag.String("usageLedger", "", "Path of the JSON file with the storage usage of the tenants, empty to keep it in memory")
+	tlsCert                   = flag.String("tlsCert", "", "Path of the TLS certificate, enables HTTPS and WSS together with tlsKey")
+	tlsKey                    = flag.String("tlsKey", "", "Path of the TLS private key")
+	tlsReloadInterval         = flag.Duration("tlsReloadInterval", 10*time.Second, "Interval of the checks for a renewed TLS certificate")
+	clamd                     = flag.String("clamd", "", "Address of clamd for malware scans (e.g. unix:/var/run/clamav/clamd.ctl or tcp:127.0.0.1:3310), empty to disable")
+	scanTimeout               = flag.Duration("scanTimeout", 5*time.Minute, "Maximum duration of a malware scan, 0 for unlimited")
+	scanSpooled               = flag.Bool("scanSpooled", false, "Scan the temporary file of an upload instead of the streamed bytes (requires saveUploadsTemporarily)")
+	infectedAction            = flag.String("infectedAction", "abort", "What to do with infected uploads (abort, quarantine)")
+	quarantinePrefix          = flag.String("quarantinePrefix", "quarantine/", "Object key prefix of quarantined uploads")
+	auditLog                  = flag.String("auditLog", "", "Path of the audit log of the upload lifecycle events, empty to disable it")
+	auditChain                = flag.Bool("auditChain", true, "Chain the records of the audit log with SHA-256 hashes")
+	auditMaxSize              = flag.Int("auditMaxSize", 100, "Size in megabytes after which the audit log is rotated")
+	auditMaxBackups           = flag.Int("auditMaxBackups", 0, "Number of rotated audit logs that are kept, 0 to keep all")
+	auditMaxAge               = flag.Int("auditMaxAge", 0, "Number of days the rotated audit logs are kept, 0 to keep them forever")
+	auditCompress             = flag.Bool("auditCompress", false, "Compress the rotated audit logs")
+	grpcAddr                  = flag.String("grpcAddr", "", "gRPC service address (e.g. localhost:9090), empty to disable")
+	shutdownGracePeriod       = flag.Duration("shutdownGracePeriod", 30*time.Second, "How long the uploads in progress may take to finish on shutdown before they are cancelled")
 
 	streamTemplate     *template.Template
 	fileSelectTemplate *template.Template
+
+	// certificates serves the TLS certificate, nil if TLS is disabled.
+	certificates *certs.Reloader
+
+	// httpServer and grpcServer are the servers, which are shut down on SIGTERM or SIGINT.
+	// grpcServer is nil if the gRPC service is disabled.
+	httpServer *http.Server
+	grpcServer *grpc.Server
 )
 
+// shutdownTimeout is how long the servers and the cancelled uploads may take to stop after the grace period.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	flag.Parse()
 
 	core.InitializeLogger()
 
-	fmt.Printf("Starting `media_uploader` at http://%s\n", *addr)
+	var err error
+
+	if *tlsCert != "" || *tlsKey != "" {
+		certificates, err = certs.NewReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			core.LogError("Failed to load TLS certificate", err)
+			return
+		}
+		go certificates.Watch(*tlsReloadInterval)
+	}
+
+	scheme := "http"
+	if certificates != nil {
+		scheme = "https"
+	}
+	fmt.Printf("Starting `media_uploader` at %s://%s\n", scheme, *addr)
 
-	handlers.InitializeWorkerConfig(*workers, *chBufferSize, *workerMemoryLimit)
+	err = initializeWorkers()
+	if err != nil {
+		core.LogError("Failed to initialize workers", err)
+		return
+	}
 	handlers.SaveUploadsTemporarily = *saveUploadsTemporarily
+	handlers.MaxStreamsPerConn = *maxStreamsPerConn
+	handlers.AllowClientMediaId = *allowClientMediaId
 
-	var err error
+	err = initializeUploadLimits()
+	if err != nil {
+		core.LogError("Failed to parse upload limits", err)
+		return
+	}
+
+	switch *storageBackend {
+	case "r2":
+	case "memory":
+		handlers.Storage = storage.NewMemoryStorage()
+	default:
+		core.LogError("Failed to initialize storage", fmt.Errorf("unknown storage: %q", *storageBackend))
+		return
+	}
+
+	err = handlers.InitializeAuth(*jwtSecret, *jwks, *jwtIssuer, *jwtAudience, *jwtTenantClaim)
+	if err != nil {
+		core.LogError("Failed to initialize authentication", err)
+		return
+	}
+
+	err = handlers.InitializeAPIKeys(*apiKeys)
+	if err != nil {
+		core.LogError("Failed to initialize API keys", err)
+		return
+	}
+
+	if *auditLog != "" {
+		handlers.AuditLog, err = audit.Open(audit.Options{
+			Path:       *auditLog,
+			Chain:      *auditChain,
+			MaxSize:    *auditMaxSize,
+			MaxBackups: *auditMaxBackups,
+			MaxAge:     *auditMaxAge,
+			Compress:   *auditCompress,
+		})
+		if err != nil {
+			core.LogError("Failed to open audit log", err)
+			return
+		}
+	}
+
+	handlers.InitializeTickets(*ticketSecret, *ticketMaxTTL)
+	handlers.RequireTickets = *requireTickets
+	handlers.InitializeTus(*tusExpiration)
+	handlers.InitializeFetch()
 
 	fmt.Println("enableSimpleInterface: ", *enableSimpleInterface)
 	if *perf {
@@ -56,30 +210,345 @@ func main() {
 	}
 
 	http.HandleFunc("/upload_stream", handlers.StreamHandler)
+	http.HandleFunc("/upload_mux", handlers.MuxStreamHandler)
+	http.HandleFunc("/upload", handlers.FormUploadHandler)
+	http.HandleFunc("/files/", handlers.TusHandler)
+	http.HandleFunc("/fetch", handlers.FetchHandler)
+	http.HandleFunc("/tickets", handlers.TicketHandler)
+	http.HandleFunc("/usage", handlers.UsageHandler)
+	http.HandleFunc("/admin/keys", handlers.AdminKeysHandler)
+	http.HandleFunc("/admin/keys/", handlers.AdminKeysHandler)
 
 	if *enableSimpleInterface {
 		http.HandleFunc("/stream", stream)
 		http.HandleFunc("/file_select", fileSelect)
 	}
 
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	httpServer = &http.Server{Addr: *addr}
+	if certificates != nil {
+		httpServer.TLSConfig = certificates.TLSConfig()
+	}
 	go func() {
-		err = http.ListenAndServe(*addr, nil)
-		if err != nil {
+		err := serveHTTP()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			core.LogFatal("Failed to start server", err)
 		}
 	}()
 
-	if !*useSpawnerWithMemoryLimit {
-		handlers.WorkerPool.Start()
-	} else {
-		handlers.WorkerSpawner.Start()
+	if *grpcAddr != "" {
+		var opts []grpc.ServerOption
+		if certificates != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(certificates.TLSConfig())))
+		}
+		grpcServer = handlers.NewGrpcServer(opts...)
+
+		go func() {
+			err := serveGrpc()
+			if err != nil {
+				core.LogFatal("Failed to start gRPC server", err)
+			}
+		}()
 	}
 
-	if !*useSpawnerWithMemoryLimit {
-		handlers.WorkerPool.Close()
-	} else {
-		handlers.WorkerSpawner.Close()
+	sig := <-signals
+	core.LogInfo(fmt.Sprintf("Received %s, shutting down", sig))
+	fmt.Printf("Shutting down, waiting up to %s for the uploads in progress\n", *shutdownGracePeriod)
+	shutdown()
+}
+
+// shutdown stops the server gracefully. New uploads are refused and the connected clients are told to finish
+// their uploads or to reconnect elsewhere. The uploads in progress have the grace period to finish, then the
+// remaining ones are cancelled, which aborts their multipart uploads, before the servers are shut down.
+func shutdown() {
+	handlers.Drain()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownGracePeriod)
+	defer cancel()
+
+	if err := handlers.WorkerPool.Shutdown(ctx); err != nil {
+		stats := handlers.WorkerPool.Stats()
+		core.LogWarning(fmt.Sprintf("Grace period is over, the remaining %d uploads are cancelled", stats.Running+int64(stats.Queued)))
+		waitForWorkers(shutdownTimeout)
+	}
+
+	// An RPC returns with its task, which has finished or has been cancelled, so the remaining RPCs
+	// only have to send their results.
+	if grpcServer != nil {
+		stopGrpc(shutdownTimeout)
 	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		core.LogError("Failed to shut down server", err)
+		httpServer.Close()
+	}
+
+	// The idle tus uploads can't be resumed after a restart.
+	handlers.TusStore.Shutdown()
+
+	if err := handlers.AuditLog.Close(); err != nil {
+		core.LogError("Failed to close audit log", err)
+	}
+	core.LogInfo("Shut down")
+}
+
+// stopGrpc stops the gRPC server gracefully, and waits up to the timeout for the RPCs to return
+// before they are closed.
+func stopGrpc(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		core.LogWarning("Timed out waiting for the RPCs")
+		grpcServer.Stop()
+	}
+}
+
+// waitForWorkers waits up to the timeout for the cancelled tasks to abort their uploads.
+func waitForWorkers(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		handlers.WorkerPool.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		core.LogWarning("Timed out waiting for the cancelled uploads")
+	}
+}
+
+// initializeWorkers creates the pool of the scheduling strategy. The spawner and the hybrid admit tasks
+// based on the memory budget or the memory limit of the cgroup.
+func initializeWorkers() error {
+	budget, err := tasks.ParseByteSize(*workerMemoryBudget)
+	if err != nil {
+		return err
+	}
+
+	strategy := *scheduler
+	// The deprecated flag selects the strategy unless the scheduler is given as well.
+	if isFlagSet("useSpawnerWithMemoryLimit") && !isFlagSet("scheduler") {
+		core.LogWarning("useSpawnerWithMemoryLimit is deprecated, use scheduler instead")
+		strategy = core.StrategyPool
+		if *useSpawnerWithMemoryLimit {
+			strategy = core.StrategySpawner
+		}
+	}
+
+	return handlers.InitializeWorkerConfig(core.PoolConfig{
+		Strategy:     strategy,
+		Workers:      *workers,
+		QueueSize:    *chBufferSize,
+		QueueTimeout: *queueTimeout,
+		TaskTimeout:  *taskTimeout,
+		Memory:       core.NewMemoryAdmission(core.RuntimeMemory{}, uint64(budget), *workerMemoryLimit, *workerMemoryResume),
+	})
+}
+
+// isFlagSet reports whether the flag has been given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func initializeUploadLimits() error {
+	var err error
+
+	handlers.UploadLimits.Max, err = tasks.ParseByteSize(*maxUploadSize)
+	if err != nil {
+		return err
+	}
+
+	handlers.UploadLimits.ByMimeType, err = tasks.ParseSizeLimits(*maxUploadSizeByMime)
+	if err != nil {
+		return err
+	}
+
+	handlers.MaxMessageSize, err = tasks.ParseByteSize(*maxMessageSize)
+	if err != nil {
+		return err
+	}
+
+	handlers.TypePolicy, err = tasks.ParseTypePolicy(*typePolicy)
+	if err != nil {
+		return err
+	}
+
+	handlers.Keepalive = tasks.KeepaliveOptions{
+		PingInterval: *wsPingInterval,
+		PongTimeout:  *wsPongTimeout,
+		ReadTimeout:  *wsReadTimeout,
+		MaxDuration:  *wsMaxDuration,
+	}
+
+	handlers.FetchOptions.Timeout = *fetchTimeout
+	handlers.FetchOptions.MaxRedirects = *fetchMaxRedirects
+	handlers.FetchOptions.AllowPrivateNetworks = *fetchAllowPrivateNetworks
+	handlers.FetchOptions.MaxSize, err = tasks.ParseByteSize(*fetchMaxSize)
+	if err != nil {
+		return err
+	}
+
+	err = initializeAllowedOrigins()
+	if err != nil {
+		return err
+	}
+
+	err = initializeRateLimits()
+	if err != nil {
+		return err
+	}
+
+	err = initializeQuotas()
+	if err != nil {
+		return err
+	}
+
+	err = initializeScanning()
+	if err != nil {
+		return err
+	}
+
+	if *policyFile != "" {
+		handlers.UploadPolicies, err = tasks.LoadPolicyConfig(*policyFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func initializeAllowedOrigins() error {
+	origins := strings.Split(*allowedOrigins, ",")
+	if *originsFile != "" {
+		fileOrigins, err := handlers.LoadOriginAllowlist(*originsFile, *environment)
+		if err != nil {
+			return err
+		}
+		origins = append(origins, fileOrigins...)
+	}
+
+	allowlist, err := handlers.ParseOriginAllowlist(origins)
+	if err != nil {
+		return err
+	}
+	allowlist.AllowAll = *allowAllOrigins
+	if allowlist.AllowAll {
+		core.LogWarning("WebSocket connections are allowed from every origin")
+	}
+
+	handlers.AllowedOrigins = allowlist
+	return nil
+}
+
+func initializeRateLimits() error {
+	if *connectionRate > 0 {
+		handlers.ConnectionRate = ratelimit.NewLimiter(*connectionRate, *connectionBurst)
+	}
+
+	byteRate, err := tasks.ParseByteSize(*uploadByteRate)
+	if err != nil {
+		return err
+	}
+	byteBurst, err := tasks.ParseByteSize(*uploadByteBurst)
+	if err != nil {
+		return err
+	}
+	if byteRate > 0 {
+		handlers.ByteRate = ratelimit.NewLimiter(float64(byteRate), int(byteBurst))
+	}
+
+	if *maxConcurrentUploads > 0 {
+		handlers.ConcurrentUploads = ratelimit.NewConcurrency(*maxConcurrentUploads, 5*time.Second)
+	}
+
+	return nil
+}
+
+func initializeQuotas() error {
+	var config quota.Config
+	var err error
+
+	if *quotaFile != "" {
+		config, err = quota.LoadConfig(*quotaFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The flags override the default quota of the file.
+	maxBytes, err := tasks.ParseByteSize(*tenantMaxBytes)
+	if err != nil {
+		return err
+	}
+	if maxBytes > 0 {
+		config.Default.MaxBytes = maxBytes
+	}
+	if *tenantMaxObjects > 0 {
+		config.Default.MaxObjects = *tenantMaxObjects
+	}
+
+	return handlers.InitializeQuotas(*usageLedger, config)
+}
+
+func initializeScanning() error {
+	if *clamd == "" {
+		return nil
+	}
+
+	switch *infectedAction {
+	case "abort":
+	case "quarantine":
+		handlers.Scan.Quarantine = true
+	default:
+		return fmt.Errorf("unknown infected action: %q", *infectedAction)
+	}
+
+	if *scanSpooled && !*saveUploadsTemporarily {
+		return fmt.Errorf("scanSpooled requires saveUploadsTemporarily")
+	}
+
+	handlers.Scan.Scanner = scan.NewClamd(*clamd, *scanTimeout)
+	handlers.Scan.Spooled = *scanSpooled
+	handlers.Scan.QuarantinePrefix = *quarantinePrefix
+	return nil
+}
+
+func serveHTTP() error {
+	if httpServer.TLSConfig == nil {
+		return httpServer.ListenAndServe()
+	}
+
+	// The certificate is served by the TLS config, so no files are passed.
+	return httpServer.ListenAndServeTLS("", "")
+}
+
+func serveGrpc() error {
+	listener, err := net.Listen("tcp", *grpcAddr)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Starting gRPC service at %s\n", *grpcAddr)
+	return grpcServer.Serve(listener)
 }
 
 func parseHTMLTemplates() error {
@@ -98,10 +567,20 @@ func parseHTMLTemplates() error {
 	return nil
 }
 
+// websocketURL returns the URL of a WebSocket endpoint with the scheme of the request,
+// so pages served over HTTPS connect with wss.
+func websocketURL(r *http.Request, path string) string {
+	scheme := "ws"
+	if r.TLS != nil {
+		scheme = "wss"
+	}
+	return scheme + "://" + r.Host + path
+}
+
 func stream(w http.ResponseWriter, r *http.Request) {
-	streamTemplate.Execute(w, "ws://"+r.Host+"/upload_stream")
+	streamTemplate.Execute(w, websocketURL(r, "/upload_stream"))
 }
 
 func fileSelect(w http.ResponseWriter, r *http.Request) {
-	fileSelectTemplate.Execute(w, "ws://"+r.Host+"/upload_stream")
+	fileSelectTemplate.Execute(w, websocketURL(r, "/upload_stream"))
 }
@@ -0,0 +1,137 @@
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/media_uploader/core"
+)
+
+// Usage is the storage used by a tenant.
+type Usage struct {
+	Bytes   int64 `json:"bytes"`
+	Objects int64 `json:"objects"`
+}
+
+// add returns the sum of both usages.
+func (u Usage) add(other Usage) Usage {
+	return Usage{Bytes: u.Bytes + other.Bytes, Objects: u.Objects + other.Objects}
+}
+
+// Ledger keeps the storage usage of the tenants. It's updated as uploads complete.
+type Ledger interface {
+	// Usage returns the usage of a tenant.
+	Usage(tenant string) (Usage, error)
+	// Usages returns the usage of every tenant that has stored something.
+	Usages() (map[string]Usage, error)
+	// Record adds a delta to the usage of a tenant.
+	Record(tenant string, delta Usage) error
+}
+
+// MemoryLedger is a ledger that lives in memory. The usage is lost when the server stops.
+type MemoryLedger struct {
+	mu     sync.RWMutex
+	usages map[string]Usage
+}
+
+// NewMemoryLedger creates an empty ledger.
+func NewMemoryLedger() *MemoryLedger {
+	return &MemoryLedger{usages: make(map[string]Usage)}
+}
+
+// Usage returns the usage of a tenant.
+func (l *MemoryLedger) Usage(tenant string) (Usage, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.usages[tenant], nil
+}
+
+// Usages returns a copy of the usage of every tenant.
+func (l *MemoryLedger) Usages() (map[string]Usage, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	usages := make(map[string]Usage, len(l.usages))
+	for tenant, usage := range l.usages {
+		usages[tenant] = usage
+	}
+	return usages, nil
+}
+
+// Record adds a delta to the usage of a tenant.
+func (l *MemoryLedger) Record(tenant string, delta Usage) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.usages[tenant] = l.usages[tenant].add(delta)
+	return nil
+}
+
+// FileLedger is a ledger that is persisted to a JSON file, which maps the tenants to their usage.
+// The file is rewritten atomically after every change.
+type FileLedger struct {
+	path string
+
+	mu     sync.RWMutex
+	usages map[string]Usage
+}
+
+// OpenFileLedger opens the ledger of a file. A missing file is created with the first change.
+func OpenFileLedger(path string) (*FileLedger, error) {
+	l := &FileLedger{path: path, usages: make(map[string]Usage)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &l.usages); err != nil {
+		return nil, fmt.Errorf("invalid ledger file %s: %w", path, err)
+	}
+	return l, nil
+}
+
+// Usage returns the usage of a tenant.
+func (l *FileLedger) Usage(tenant string) (Usage, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.usages[tenant], nil
+}
+
+// Usages returns a copy of the usage of every tenant.
+func (l *FileLedger) Usages() (map[string]Usage, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	usages := make(map[string]Usage, len(l.usages))
+	for tenant, usage := range l.usages {
+		usages[tenant] = usage
+	}
+	return usages, nil
+}
+
+// Record adds a delta to the usage of a tenant and persists the ledger.
+// The change is kept in memory even if it can't be persisted, so it's written with the next one.
+func (l *FileLedger) Record(tenant string, delta Usage) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.usages[tenant] = l.usages[tenant].add(delta)
+	return l.persist()
+}
+
+// persist writes the ledger to a temporary file and renames it, so the file is never half-written.
+// The caller must hold the mutex.
+func (l *FileLedger) persist() error {
+	data, err := json.MarshalIndent(l.usages, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return core.WriteFileAtomic(l.path, data)
+}
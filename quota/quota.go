@@ -0,0 +1,234 @@
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// ErrQuotaExceeded is returned when an upload would exceed the storage quota of its tenant.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Limit is the storage quota of a tenant. Zero values are unlimited.
+type Limit struct {
+	// MaxBytes is the maximum number of stored bytes.
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+	// MaxObjects is the maximum number of stored objects.
+	MaxObjects int64 `json:"maxObjects,omitempty"`
+}
+
+// Config holds the quotas. Tenants without their own quota get the default one.
+type Config struct {
+	Default Limit `json:"default"`
+	// Tenants maps a tenant to its quota.
+	Tenants map[string]Limit `json:"tenants,omitempty"`
+}
+
+// LoadConfig loads the quotas from a JSON file.
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return Config{}, fmt.Errorf("invalid quota file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// Report is the usage of a tenant with its quota.
+type Report struct {
+	Tenant string `json:"tenant"`
+	// Usage is the storage of the completed uploads.
+	Usage Usage `json:"usage"`
+	// InFlight is the storage of the uploads that are in progress.
+	InFlight Usage `json:"inFlight"`
+	Limit    Limit `json:"limit"`
+}
+
+// Quotas enforces the storage quotas of the tenants and accounts the completed uploads in a ledger.
+// Uploads that are in progress are reserved, so concurrent uploads of a tenant can't exceed its quota together.
+// Uploads without a tenant are not accounted. A nil Quotas doesn't limit anything.
+type Quotas struct {
+	ledger Ledger
+	config Config
+
+	mu       sync.Mutex
+	inFlight map[string]Usage
+}
+
+// NewQuotas creates the quotas of the config on top of a ledger.
+func NewQuotas(ledger Ledger, config Config) *Quotas {
+	return &Quotas{ledger: ledger, config: config, inFlight: make(map[string]Usage)}
+}
+
+// limitFor returns the quota of a tenant.
+func (q *Quotas) limitFor(tenant string) Limit {
+	if limit, ok := q.config.Tenants[tenant]; ok {
+		return limit
+	}
+	return q.config.Default
+}
+
+// Check checks whether an upload of the declared size (zero if it's unknown) fits into the quota of the tenant.
+// It's meant for the handshake, the bytes are reserved as they arrive.
+func (q *Quotas) Check(tenant string, size int64) error {
+	if q == nil || tenant == "" {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.admit(tenant, Usage{Bytes: size, Objects: 1})
+}
+
+// Reserve reserves an object for an upload of the tenant. The reservation has to be committed
+// when the upload is completed or released when it's aborted.
+func (q *Quotas) Reserve(tenant string) (*Reservation, error) {
+	if q == nil || tenant == "" {
+		return nil, nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delta := Usage{Objects: 1}
+	if err := q.admit(tenant, delta); err != nil {
+		return nil, err
+	}
+	q.inFlight[tenant] = q.inFlight[tenant].add(delta)
+	return &Reservation{quotas: q, tenant: tenant}, nil
+}
+
+// admit checks whether the delta fits into the quota next to the stored and the reserved usage.
+// The caller must hold the mutex.
+func (q *Quotas) admit(tenant string, delta Usage) error {
+	limit := q.limitFor(tenant)
+	if limit.MaxBytes == 0 && limit.MaxObjects == 0 {
+		return nil
+	}
+
+	usage, err := q.ledger.Usage(tenant)
+	if err != nil {
+		return err
+	}
+	usage = usage.add(q.inFlight[tenant])
+
+	if limit.MaxObjects > 0 && delta.Objects > 0 && usage.Objects+delta.Objects > limit.MaxObjects {
+		return fmt.Errorf("%w: tenant %s stores %d of %d objects", ErrQuotaExceeded, tenant, usage.Objects, limit.MaxObjects)
+	}
+	if limit.MaxBytes > 0 && delta.Bytes > 0 && usage.Bytes+delta.Bytes > limit.MaxBytes {
+		return fmt.Errorf("%w: tenant %s stores %d of %d bytes", ErrQuotaExceeded, tenant, usage.Bytes, limit.MaxBytes)
+	}
+	return nil
+}
+
+// release removes a reservation from the in-flight usage.
+// The caller must hold the mutex.
+func (q *Quotas) release(tenant string, reserved Usage) {
+	usage := q.inFlight[tenant].add(Usage{Bytes: -reserved.Bytes, Objects: -reserved.Objects})
+	if usage == (Usage{}) {
+		delete(q.inFlight, tenant)
+		return
+	}
+	q.inFlight[tenant] = usage
+}
+
+// Usage returns the usage of a tenant.
+func (q *Quotas) Usage(tenant string) (Report, error) {
+	usage, err := q.ledger.Usage(tenant)
+	if err != nil {
+		return Report{}, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return Report{Tenant: tenant, Usage: usage, InFlight: q.inFlight[tenant], Limit: q.limitFor(tenant)}, nil
+}
+
+// Usages returns the usage of every tenant that has stored something or has uploads in progress,
+// sorted by tenant.
+func (q *Quotas) Usages() ([]Report, error) {
+	usages, err := q.ledger.Usages()
+	if err != nil {
+		return nil, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for tenant := range q.inFlight {
+		if _, ok := usages[tenant]; !ok {
+			usages[tenant] = Usage{}
+		}
+	}
+
+	reports := make([]Report, 0, len(usages))
+	for tenant, usage := range usages {
+		reports = append(reports, Report{Tenant: tenant, Usage: usage, InFlight: q.inFlight[tenant], Limit: q.limitFor(tenant)})
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Tenant < reports[j].Tenant })
+	return reports, nil
+}
+
+// Reservation is the in-flight usage of an upload. A nil Reservation doesn't account anything.
+type Reservation struct {
+	quotas *Quotas
+	tenant string
+	// bytes is the number of reserved bytes.
+	bytes int64
+	done  bool
+}
+
+// Grow reserves n more bytes as they arrive. ErrQuotaExceeded is returned if they don't fit into the quota.
+func (r *Reservation) Grow(n int64) error {
+	if r == nil || n <= 0 {
+		return nil
+	}
+
+	q := r.quotas
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delta := Usage{Bytes: n}
+	if err := q.admit(r.tenant, delta); err != nil {
+		return err
+	}
+	q.inFlight[r.tenant] = q.inFlight[r.tenant].add(delta)
+	r.bytes += n
+	return nil
+}
+
+// Commit records the reserved bytes and the object in the ledger once the upload is stored.
+func (r *Reservation) Commit() error {
+	if r == nil || r.done {
+		return nil
+	}
+	r.done = true
+
+	q := r.quotas
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	reserved := Usage{Bytes: r.bytes, Objects: 1}
+	q.release(r.tenant, reserved)
+	return q.ledger.Record(r.tenant, reserved)
+}
+
+// Release gives the reservation of an aborted upload back.
+func (r *Reservation) Release() {
+	if r == nil || r.done {
+		return
+	}
+	r.done = true
+
+	q := r.quotas
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.release(r.tenant, Usage{Bytes: r.bytes, Objects: 1})
+}
@@ -0,0 +1,183 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is the minimum time between two sweeps of the idle buckets.
+const sweepInterval = time.Minute
+
+// Limiter is a token bucket rate limiter per key (e.g. a user or a client IP).
+// A nil Limiter doesn't limit anything.
+type Limiter struct {
+	// rate is the number of tokens that are added per second.
+	rate float64
+	// burst is the capacity of a bucket.
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	sweptAt time.Time
+}
+
+// bucket is the token bucket of a key.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter creates a limiter that allows rate tokens per second with bursts of burst tokens.
+// A burst smaller than the rate is raised to the rate.
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   math.Max(float64(burst), rate),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token of the key. If there is none, it returns false and the time after which a token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.refill(key, time.Now())
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, l.duration(1 - b.tokens)
+}
+
+// Wait takes n tokens of the key and waits until they are available. The bucket may go into debt,
+// so n can be larger than the burst. An error is returned if the context is done before.
+func (l *Limiter) Wait(ctx context.Context, key string, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	b := l.refill(key, time.Now())
+	b.tokens -= float64(n)
+	delay := time.Duration(0)
+	if b.tokens < 0 {
+		delay = l.duration(-b.tokens)
+	}
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// refill returns the bucket of the key with the tokens added since the last use.
+// The caller must hold the mutex.
+func (l *Limiter) refill(key string, now time.Time) *bucket {
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+		return b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	return b
+}
+
+// sweep removes the buckets that have been refilled completely, since they are equal to new ones.
+// The caller must hold the mutex.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.sweptAt) < sweepInterval {
+		return
+	}
+	l.sweptAt = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// duration returns the time until the given number of tokens has been added.
+func (l *Limiter) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// Concurrency caps the number of concurrent operations per key.
+// A nil Concurrency doesn't limit anything.
+type Concurrency struct {
+	// max is the default cap, zero for unlimited.
+	max int
+	// RetryAfter is the time after which a client at its cap is asked to try again.
+	RetryAfter time.Duration
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// NewConcurrency creates a cap of max concurrent operations per key, zero for unlimited.
+func NewConcurrency(max int, retryAfter time.Duration) *Concurrency {
+	return &Concurrency{max: max, RetryAfter: retryAfter, counts: make(map[string]int)}
+}
+
+// Acquire starts an operation of the key. It returns false if the key is at its cap.
+// Every successful Acquire has to be followed by a Release.
+func (c *Concurrency) Acquire(key string) bool {
+	return c.AcquireUpTo(key, 0)
+}
+
+// AcquireUpTo starts an operation of the key with a cap that overrides the default one, zero for the default cap.
+func (c *Concurrency) AcquireUpTo(key string, max int) bool {
+	if c == nil {
+		return true
+	}
+	if max <= 0 {
+		max = c.max
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if max > 0 && c.counts[key] >= max {
+		return false
+	}
+	c.counts[key]++
+	return true
+}
+
+// Release finishes an operation of the key.
+func (c *Concurrency) Release(key string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts[key] <= 1 {
+		delete(c.counts, key)
+		return
+	}
+	c.counts[key]--
+}
@@ -0,0 +1,153 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Result is the verdict of a scan.
+type Result struct {
+	Infected bool
+	// Signature is the name of the detected malware.
+	Signature string
+}
+
+// Scanner scans the content of an upload for malware.
+type Scanner interface {
+	// Scan reads the content until EOF and returns the verdict.
+	Scan(ctx context.Context, content io.Reader) (Result, error)
+}
+
+// defaultChunkSize is the size of the chunks that are sent to clamd.
+const defaultChunkSize = 64 * 1024
+
+// Clamd is a scanner that streams the content to clamd with the INSTREAM command.
+//
+// Note that clamd rejects streams larger than its StreamMaxLength (25 MB by default),
+// which has to be raised for large uploads.
+type Clamd struct {
+	// Network is "tcp" or "unix".
+	Network string
+	Address string
+	// Timeout is the maximum duration of a scan, zero for unlimited.
+	Timeout time.Duration
+	// ChunkSize is the size of the chunks that are sent to clamd.
+	ChunkSize int
+}
+
+// NewClamd creates a clamd scanner for an address like "unix:/var/run/clamav/clamd.ctl",
+// "tcp:127.0.0.1:3310" or "127.0.0.1:3310".
+func NewClamd(address string, timeout time.Duration) *Clamd {
+	network := "tcp"
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		network, address = "unix", path
+	} else if addr, ok := strings.CutPrefix(address, "tcp:"); ok {
+		address = addr
+	}
+	return &Clamd{Network: network, Address: address, Timeout: timeout, ChunkSize: defaultChunkSize}
+}
+
+// Scan streams the content to clamd and returns its verdict.
+func (c *Clamd) Scan(ctx context.Context, content io.Reader) (Result, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+
+	// Closing the connection interrupts the scan when the context is done.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := c.stream(conn, content); err != nil {
+		// clamd may have closed the stream with an error reply, e.g. if the size limit is exceeded.
+		if reply, replyErr := readReply(conn); replyErr == nil && reply != "" {
+			return parseReply(reply)
+		}
+		if ctx.Err() != nil {
+			return Result{}, ctx.Err()
+		}
+		return Result{}, err
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		if ctx.Err() != nil {
+			return Result{}, ctx.Err()
+		}
+		return Result{}, fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+	return parseReply(reply)
+}
+
+// stream sends the INSTREAM command with the content in length-prefixed chunks, terminated by an empty chunk.
+func (c *Clamd) stream(conn net.Conn, content io.Reader) error {
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return err
+	}
+
+	chunkSize := c.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	chunk := make([]byte, 4+chunkSize)
+
+	for {
+		n, err := io.ReadFull(content, chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk[:4], uint32(n))
+			if _, err := conn.Write(chunk[:4+n]); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := conn.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// readReply reads the null-terminated reply of clamd.
+func readReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && !(errors.Is(err, io.EOF) && len(reply) > 0) {
+		return "", err
+	}
+	return string(bytes.TrimRight(reply, "\x00\n")), nil
+}
+
+// parseReply parses a reply like "stream: OK", "stream: Eicar-Signature FOUND" or "... ERROR".
+func parseReply(reply string) (Result, error) {
+	_, verdict, ok := strings.Cut(reply, ": ")
+	if !ok {
+		verdict = reply
+	}
+
+	switch {
+	case verdict == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(verdict, " FOUND")}, nil
+	}
+	return Result{}, fmt.Errorf("clamd: %s", strings.TrimSpace(reply))
+}
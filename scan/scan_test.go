@@ -0,0 +1,323 @@
+package scan_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	uploader "github.com/media_uploader/amazon"
+	"github.com/media_uploader/core"
+	"github.com/media_uploader/scan"
+	"github.com/media_uploader/storage"
+	"github.com/media_uploader/tasks"
+)
+
+func TestMain(m *testing.M) {
+	// The logger writes to logs/app.log in the working directory.
+	dir, err := os.MkdirTemp("", "scan-test-*")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	core.InitializeLogger()
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// eicar is the marker of the fake clamd for infected content.
+const eicar = "EICAR-STANDARD-ANTIVIRUS-TEST-FILE"
+
+// fakeClamd answers INSTREAM commands like clamd. The reply is computed from the streamed content,
+// an empty reply never answers.
+type fakeClamd struct {
+	listener net.Listener
+	reply    func(content []byte) string
+}
+
+// startFakeClamd listens on a TCP port or a unix socket and returns the address of the scanner.
+func startFakeClamd(t *testing.T, network string, reply func(content []byte) string) string {
+	t.Helper()
+
+	address := "127.0.0.1:0"
+	if network == "unix" {
+		address = filepath.Join(t.TempDir(), "clamd.ctl")
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	clamd := &fakeClamd{listener: listener, reply: reply}
+	go clamd.serve()
+
+	return network + ":" + listener.Addr().String()
+}
+
+// virusReply reports the content with the EICAR marker as infected.
+func virusReply(content []byte) string {
+	if bytes.Contains(content, []byte(eicar)) {
+		return "stream: Eicar-Test-Signature FOUND"
+	}
+	return "stream: OK"
+}
+
+func (c *fakeClamd) serve() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			return
+		}
+		go c.handle(conn)
+	}
+}
+
+func (c *fakeClamd) handle(conn net.Conn) {
+	defer conn.Close()
+
+	command := make([]byte, len("zINSTREAM\x00"))
+	if _, err := io.ReadFull(conn, command); err != nil || string(command) != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+
+	var content []byte
+	for {
+		var size uint32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(conn, chunk); err != nil {
+			return
+		}
+		content = append(content, chunk...)
+	}
+
+	reply := c.reply(content)
+	if reply == "" {
+		// Hang until the client gives up.
+		io.Copy(io.Discard, conn)
+		return
+	}
+	conn.Write([]byte(reply + "\x00"))
+}
+
+func TestNewClamd(t *testing.T) {
+	tests := []struct {
+		address, network, want string
+	}{
+		{"unix:/var/run/clamav/clamd.ctl", "unix", "/var/run/clamav/clamd.ctl"},
+		{"tcp:127.0.0.1:3310", "tcp", "127.0.0.1:3310"},
+		{"127.0.0.1:3310", "tcp", "127.0.0.1:3310"},
+	}
+	for _, tt := range tests {
+		clamd := scan.NewClamd(tt.address, time.Minute)
+		if clamd.Network != tt.network || clamd.Address != tt.want {
+			t.Errorf("NewClamd(%q) = %s %s, want %s %s", tt.address, clamd.Network, clamd.Address, tt.network, tt.want)
+		}
+	}
+}
+
+func TestClamdScan(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		reply   string
+		result  scan.Result
+		err     string
+	}{
+		{name: "clean", content: "harmless content", reply: "stream: OK"},
+		{
+			name:    "infected",
+			content: "prefix " + eicar,
+			reply:   "stream: Eicar-Test-Signature FOUND",
+			result:  scan.Result{Infected: true, Signature: "Eicar-Test-Signature"},
+		},
+		{
+			name:    "error",
+			content: "content",
+			reply:   "INSTREAM size limit exceeded. ERROR",
+			err:     "clamd: INSTREAM size limit exceeded. ERROR",
+		},
+	}
+	for _, network := range []string{"tcp", "unix"} {
+		for _, tt := range tests {
+			t.Run(network+"/"+tt.name, func(t *testing.T) {
+				received := make(chan []byte, 1)
+				address := startFakeClamd(t, network, func(content []byte) string {
+					received <- content
+					return tt.reply
+				})
+
+				clamd := scan.NewClamd(address, 5*time.Second)
+				// Small chunks, so that the content is sent in several of them.
+				clamd.ChunkSize = 4
+
+				result, err := clamd.Scan(context.Background(), strings.NewReader(tt.content))
+				if tt.err != "" {
+					if err == nil || err.Error() != tt.err {
+						t.Fatalf("Scan() error = %v, want %q", err, tt.err)
+					}
+				} else if err != nil {
+					t.Fatalf("Scan() error = %v", err)
+				}
+				if result != tt.result {
+					t.Errorf("Scan() = %+v, want %+v", result, tt.result)
+				}
+				if content := <-received; string(content) != tt.content {
+					t.Errorf("clamd received %q, want %q", content, tt.content)
+				}
+			})
+		}
+	}
+}
+
+func TestClamdTimeout(t *testing.T) {
+	address := startFakeClamd(t, "tcp", func([]byte) string { return "" })
+	clamd := scan.NewClamd(address, 100*time.Millisecond)
+
+	start := time.Now()
+	_, err := clamd.Scan(context.Background(), strings.NewReader("content"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Scan() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Scan() returned after %s, want about the timeout", elapsed)
+	}
+}
+
+func TestClamdUnreachable(t *testing.T) {
+	clamd := scan.NewClamd("unix:"+filepath.Join(t.TempDir(), "missing.ctl"), time.Second)
+	if _, err := clamd.Scan(context.Background(), strings.NewReader("content")); err == nil {
+		t.Fatal("Scan() without clamd succeeded")
+	}
+}
+
+// testMP4 returns data that is detected as video/mp4 and contains the marker.
+func testMP4(marker string) []byte {
+	data := append([]byte("\x00\x00\x00\x20ftypisom"), bytes.Repeat([]byte{0x42}, 600)...)
+	return append(data, marker...)
+}
+
+// tusUpload uploads data with a tus store in one PATCH request and returns its status code and the error
+// of the task.
+func tusUpload(t *testing.T, store *tasks.TusStore, mediaId string, data []byte) (int, error) {
+	t.Helper()
+
+	metadata := "filetype " + base64.StdEncoding.EncodeToString([]byte("video/mp4")) +
+		",mediaId " + base64.StdEncoding.EncodeToString([]byte(mediaId))
+
+	create := httptest.NewRequest(http.MethodPost, store.BasePath, nil)
+	create.Header.Set("Upload-Length", strconv.Itoa(len(data)))
+	create.Header.Set("Upload-Metadata", metadata)
+	recorder := httptest.NewRecorder()
+	store.Create(recorder, create, store.UploadOptions)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Create status = %d, want %d", recorder.Code, http.StatusCreated)
+	}
+
+	patch := httptest.NewRequest(http.MethodPatch, store.BasePath+mediaId, bytes.NewReader(data))
+	patch.Header.Set("Content-Type", "application/offset+octet-stream")
+	patch.Header.Set("Upload-Offset", "0")
+	recorder = httptest.NewRecorder()
+	task := &tasks.TusPatchTask{Store: store, Id: mediaId, Writer: recorder, Request: patch, Done: make(chan struct{})}
+	err := task.Execute()
+	return recorder.Code, err
+}
+
+func TestUploadScanOutcomes(t *testing.T) {
+	tests := []struct {
+		name       string
+		reply      func([]byte) string
+		quarantine bool
+		marker     string
+		status     int
+		// stored is the object key of the stored upload, empty if nothing is stored.
+		stored string
+	}{
+		{name: "clean", reply: virusReply, status: http.StatusNoContent, stored: "clean.mp4"},
+		{name: "abort", reply: virusReply, marker: eicar, status: http.StatusUnprocessableEntity},
+		{
+			name:       "quarantine",
+			reply:      virusReply,
+			quarantine: true,
+			marker:     eicar,
+			status:     http.StatusUnprocessableEntity,
+			stored:     "quarantine/quarantine.mp4",
+		},
+		{
+			name:   "scan error",
+			reply:  func([]byte) string { return "stream: Can't allocate memory ERROR" },
+			status: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := storage.NewMemoryStorage()
+			store := tasks.NewTusStore(tasks.UploadOptions{
+				AllowClientMediaId: true,
+				Storage:            backend,
+				Scan: tasks.ScanOptions{
+					Scanner:          scan.NewClamd(startFakeClamd(t, "tcp", tt.reply), 5*time.Second),
+					Quarantine:       tt.quarantine,
+					QuarantinePrefix: "quarantine/",
+				},
+			}, "/files/", time.Hour)
+
+			mediaId := strings.ReplaceAll(tt.name, " ", "-")
+			if status, _ := tusUpload(t, store, mediaId, testMP4(tt.marker)); status != tt.status {
+				t.Errorf("PATCH status = %d, want %d", status, tt.status)
+			}
+
+			for _, key := range []string{mediaId + ".mp4", "quarantine/" + mediaId + ".mp4"} {
+				_, ok := backend.Object(uploader.ObjectKey(key))
+				if want := key == tt.stored; ok != want {
+					t.Errorf("object %s stored = %v, want %v", key, ok, want)
+				}
+			}
+		})
+	}
+}
+
+// earlyScanner returns a clean verdict without reading the content.
+type earlyScanner struct{}
+
+func (earlyScanner) Scan(ctx context.Context, content io.Reader) (scan.Result, error) {
+	return scan.Result{}, nil
+}
+
+func TestUploadScannerStoppedEarly(t *testing.T) {
+	store := tasks.NewTusStore(tasks.UploadOptions{
+		AllowClientMediaId: true,
+		Storage:            storage.NewMemoryStorage(),
+		Scan:               tasks.ScanOptions{Scanner: earlyScanner{}},
+	}, "/files/", time.Hour)
+
+	status, err := tusUpload(t, store, "early", testMP4(""))
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("PATCH status = %d, want %d", status, http.StatusServiceUnavailable)
+	}
+	if !errors.Is(err, tasks.ErrScanFailed) || strings.Contains(err.Error(), "<nil>") {
+		t.Errorf("task error = %v, want the reason of the failed scan", err)
+	}
+}
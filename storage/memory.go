@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	uploader "github.com/media_uploader/amazon"
+)
+
+// Object represents a file stored by MemoryStorage.
+type Object struct {
+	ContentType string
+	Data        []byte
+}
+
+// MemoryStorage keeps the files in memory. It's meant for development and tests,
+// and produces the same locations as the S3 storage.
+type MemoryStorage struct {
+	mu      sync.Mutex
+	objects map[string]Object
+}
+
+// memoryMultipartUpload represents a multipart upload of MemoryStorage.
+type memoryMultipartUpload struct {
+	storage     *MemoryStorage
+	contentType string
+	fileName    string
+
+	mu    sync.Mutex
+	parts map[int32][]byte
+	done  bool
+}
+
+// NewMemoryStorage creates an empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{objects: make(map[string]Object)}
+}
+
+// Object returns the stored file with the given key.
+func (s *MemoryStorage) Object(key string) (Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	object, ok := s.objects[key]
+	return object, ok
+}
+
+// DirectUpload stores a file unless it already exists.
+func (s *MemoryStorage) DirectUpload(ctx context.Context, contentType, fileName string, data []byte) (string, error) {
+	return s.put(contentType, fileName, append([]byte(nil), data...))
+}
+
+// StartMultipart initializes a multipart upload.
+func (s *MemoryStorage) StartMultipart(ctx context.Context, contentType, fileName string) (MultipartUpload, error) {
+	return &memoryMultipartUpload{
+		storage:     s,
+		contentType: contentType,
+		fileName:    fileName,
+		parts:       make(map[int32][]byte),
+	}, nil
+}
+
+// put stores a file unless it already exists and returns its location.
+func (s *MemoryStorage) put(contentType, fileName string, data []byte) (string, error) {
+	key := uploader.ObjectKey(fileName)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.objects[key]; ok {
+		return "", ErrObjectExists
+	}
+	s.objects[key] = Object{ContentType: contentType, Data: data}
+
+	return uploader.PublicURL(key), nil
+}
+
+// UploadPart keeps a copy of the part.
+func (u *memoryMultipartUpload) UploadPart(ctx context.Context, partNumber int32, data []byte) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.done {
+		return errors.New("multipart upload is already finished")
+	}
+	u.parts[partNumber] = append([]byte(nil), data...)
+	return nil
+}
+
+// Complete concatenates the parts in order and stores the file.
+func (u *memoryMultipartUpload) Complete(ctx context.Context) (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.done {
+		return "", errors.New("multipart upload is already finished")
+	}
+	u.done = true
+
+	numbers := make([]int32, 0, len(u.parts))
+	for number := range u.parts {
+		numbers = append(numbers, number)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	var data []byte
+	for _, number := range numbers {
+		data = append(data, u.parts[number]...)
+	}
+	u.parts = nil
+
+	return u.storage.put(u.contentType, u.fileName, data)
+}
+
+// Abort discards the parts.
+func (u *memoryMultipartUpload) Abort(ctx context.Context) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.done = true
+	u.parts = nil
+	return nil
+}
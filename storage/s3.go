@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	uploader "github.com/media_uploader/amazon"
+)
+
+// S3Storage stores the files on Cloudflare R2 (AWS S3).
+type S3Storage struct{}
+
+// s3MultipartUpload represents a multipart upload on S3.
+type s3MultipartUpload struct {
+	svc  *s3.Client
+	resp *s3.CreateMultipartUploadOutput
+
+	mu             sync.Mutex
+	completedParts []types.CompletedPart
+}
+
+// DirectUpload uploads a file without using multipart upload.
+func (S3Storage) DirectUpload(ctx context.Context, contentType, fileName string, data []byte) (string, error) {
+	return uploader.DirectUpload(&ctx, contentType, fileName, data)
+}
+
+// StartMultipart initializes a multipart upload.
+func (S3Storage) StartMultipart(ctx context.Context, contentType, fileName string) (MultipartUpload, error) {
+	svc, resp, err := uploader.StreamUploadInit(&ctx, contentType, fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &s3MultipartUpload{svc: svc, resp: resp}, nil
+}
+
+// UploadPart uploads a part and keeps its ETag for the completion.
+func (u *s3MultipartUpload) UploadPart(ctx context.Context, partNumber int32, data []byte) error {
+	uploadResult, err := uploader.StreamUpload(&ctx, u.svc, u.resp, data, partNumber)
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var numb int32 = partNumber
+	u.completedParts = append(u.completedParts, types.CompletedPart{
+		ETag:       uploadResult.ETag,
+		PartNumber: &numb,
+	})
+	return nil
+}
+
+// Complete completes the multipart upload.
+func (u *s3MultipartUpload) Complete(ctx context.Context) (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return uploader.StreamDone(&ctx, u.svc, u.resp, u.completedParts)
+}
+
+// Abort aborts the multipart upload.
+func (u *s3MultipartUpload) Abort(ctx context.Context) error {
+	return uploader.StreamAbort(&ctx, u.svc, u.resp)
+}
@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"context"
+
+	uploader "github.com/media_uploader/amazon"
+)
+
+// ErrObjectExists is returned if the object already exists. Uploads never overwrite existing objects.
+var ErrObjectExists = uploader.ErrObjectExists
+
+// Storage stores the uploaded media files.
+type Storage interface {
+	// DirectUpload uploads a file in a single request and returns its location.
+	DirectUpload(ctx context.Context, contentType, fileName string, data []byte) (string, error)
+	// StartMultipart initializes a multipart upload of a file.
+	StartMultipart(ctx context.Context, contentType, fileName string) (MultipartUpload, error)
+}
+
+// MultipartUpload represents a multipart upload that is in progress.
+// Every non-trailing part must have the same size.
+type MultipartUpload interface {
+	// UploadPart uploads a part of the file. Part numbers start at 1.
+	UploadPart(ctx context.Context, partNumber int32, data []byte) error
+	// Complete completes the upload and returns the location of the file.
+	Complete(ctx context.Context) (string, error)
+	// Abort aborts the upload and discards the uploaded parts.
+	Abort(ctx context.Context) error
+}
@@ -2,7 +2,19 @@ package tasks
 
 import (
 	"encoding/json"
+	"errors"
+	"net/http"
 	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/media_uploader/audit"
+	"github.com/media_uploader/auth"
+	"github.com/media_uploader/core"
+	"github.com/media_uploader/quota"
+	"github.com/media_uploader/ratelimit"
+	"github.com/media_uploader/storage"
+	"google.golang.org/grpc/codes"
 )
 
 // FirstChunk represents a data structure for a task's first chunk that comes from the client.
@@ -10,6 +22,8 @@ type FirstChunk struct {
 	Video    bool   `json:"video"`
 	MimeType string `json:"mimeType"`
 	MediaId  string `json:"mediaId"`
+	// Size is the expected total size of the upload in bytes, zero if it's unknown.
+	Size int64 `json:"size,omitempty"`
 }
 
 // Serializer is a goroutine-safe struct that facilitates the concurrent serialization and deserialization of JSON data.
@@ -35,3 +49,214 @@ func (s *Serializer) Deserialize(data []byte) (FirstChunk, error) {
 
 // JsonSerializer is a shared instance of Serializer that can be used safely across multiple goroutines.
 var JsonSerializer = &Serializer{}
+
+// ControlFrame represents a control message that comes from the client during an upload.
+type ControlFrame struct {
+	Stream uint32 `json:"stream,omitempty"`
+	Type   string `json:"type"`
+}
+
+// MuxFrame represents a control frame of the multiplexed upload protocol that comes from the client.
+// An "open" frame carries the first chunk of a new stream, an "eof" frame finishes the stream.
+type MuxFrame struct {
+	FirstChunk
+	ControlFrame
+}
+
+// parseControlFrame returns the control frame of a text message.
+// The second return value is false if the message is not a known control frame.
+func parseControlFrame(message []byte) (ControlFrame, bool) {
+	var frame ControlFrame
+	if len(message) == 0 || message[0] != '{' {
+		return frame, false
+	}
+
+	if err := json.Unmarshal(message, &frame); err != nil {
+		return frame, false
+	}
+
+	switch frame.Type {
+	case "cancel", "pause", "resume":
+		return frame, true
+	}
+	return frame, false
+}
+
+// ServerMessage represents a structured message that is sent to the client.
+type ServerMessage struct {
+	Stream   uint32 `json:"stream,omitempty"`
+	Type     string `json:"type"`
+	Bytes    int64  `json:"bytes,omitempty"`
+	MediaId  string `json:"mediaId,omitempty"`
+	Location string `json:"location,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// Reason is the structured reason of a rejected upload.
+	Reason *Rejection `json:"reason,omitempty"`
+	// RetryAfter is the number of seconds after which a throttled client may try again.
+	RetryAfter int64 `json:"retryAfter,omitempty"`
+}
+
+// ThrottledMessage returns the message that asks a throttled client to try again later.
+func ThrottledMessage(stream uint32, reason string, retryAfter time.Duration) ServerMessage {
+	return ServerMessage{Stream: stream, Type: "throttled", Error: reason, RetryAfter: retryAfterSeconds(retryAfter)}
+}
+
+// retryAfterSeconds rounds a duration up to whole seconds, at least one.
+func retryAfterSeconds(d time.Duration) int64 {
+	return max(int64((d+time.Second-1)/time.Second), 1)
+}
+
+// UploadOptions represents the settings shared by the upload tasks.
+type UploadOptions struct {
+	SaveUploadsTemporarily bool
+	// AllowClientMediaId allows the client to choose the media id instead of the server.
+	AllowClientMediaId bool
+	// Limits are the maximum upload sizes.
+	Limits SizeLimits
+	// MaxMessageSize is the maximum size of a single message in bytes, zero for unlimited.
+	MaxMessageSize int64
+	// Keepalive are the timeouts of WebSocket connections.
+	Keepalive KeepaliveOptions
+	// TypePolicy decides what happens if the content doesn't match the declared MIME type.
+	TypePolicy TypePolicy
+	// Policies are the upload policies, nil admits every upload.
+	Policies *PolicyConfig
+	// Endpoint is the name of the endpoint that has received the upload.
+	Endpoint string
+	// Tenant is the tenant of the client, empty if it's unknown.
+	Tenant string
+	// Claims are the verified claims of the client, nil if authentication is disabled.
+	Claims *auth.Claims
+	// Ticket is the upload ticket that authorizes the upload, nil if there is none.
+	Ticket *auth.Ticket
+	// ClientIP is the IP address of the client.
+	ClientIP string
+	// ClientKey identifies the client for rate limiting (e.g. "sub:alice" or "ip:203.0.113.7").
+	ClientKey string
+	// ByteRate limits the received bytes per second of a client, nil for unlimited.
+	ByteRate *ratelimit.Limiter
+	// Uploads caps the concurrent uploads of a client, nil for unlimited.
+	// It's used by the tasks with several uploads, the others are capped by their handlers.
+	Uploads *ratelimit.Concurrency
+	// Scan are the settings of the malware scans.
+	Scan ScanOptions
+	// Quotas are the storage quotas of the tenants, nil for unlimited.
+	Quotas *quota.Quotas
+	// Audit records the lifecycle events of the uploads, nil disables it.
+	Audit *audit.Log
+	// Storage stores the uploaded files, nil for the S3 storage.
+	Storage storage.Storage
+	// Drain is closed when the server is shutting down, so the connected clients are told to finish
+	// their uploads. Nil if the server is never drained.
+	Drain <-chan struct{}
+}
+
+// WithClaims returns the options for an authenticated client. The tenant is taken from the claims.
+func (o UploadOptions) WithClaims(claims *auth.Claims) UploadOptions {
+	if claims != nil {
+		o.Claims = claims
+		o.Tenant = claims.Tenant
+	}
+	return o
+}
+
+// apiKey returns the API key of the client, nil if it has authenticated otherwise.
+func (o UploadOptions) apiKey() *auth.APIKey {
+	if o.Claims == nil {
+		return nil
+	}
+	return o.Claims.Key
+}
+
+// subject returns the subject of the token, API key or ticket of the client, empty if there is none.
+func (o UploadOptions) subject() string {
+	if o.Claims != nil {
+		return o.Claims.Subject
+	}
+	if o.Ticket != nil {
+		return o.Ticket.Subject
+	}
+	return ""
+}
+
+// WithTicket returns the options for an upload that is authorized by a ticket.
+// The tenant is taken from the ticket.
+func (o UploadOptions) WithTicket(ticket *auth.Ticket) UploadOptions {
+	o.Ticket = ticket
+	o.Tenant = ticket.Tenant
+	return o
+}
+
+// clientErrors are the upload errors that are reported to the client, with the close codes of the
+// WebSocket connection, the HTTP status codes and the gRPC status codes.
+// Other errors are internal and are not exposed.
+var clientErrors = []struct {
+	err       error
+	closeCode int
+	status    int
+	grpcCode  codes.Code
+}{
+	{ErrInvalidUpload, websocket.CloseUnsupportedData, http.StatusBadRequest, codes.InvalidArgument},
+	{ErrTooLarge, websocket.CloseMessageTooBig, http.StatusRequestEntityTooLarge, codes.OutOfRange},
+	{ErrTypeMismatch, websocket.CloseUnsupportedData, http.StatusUnsupportedMediaType, codes.InvalidArgument},
+	{ErrRejected, websocket.ClosePolicyViolation, http.StatusForbidden, codes.PermissionDenied},
+	{storage.ErrObjectExists, websocket.ClosePolicyViolation, http.StatusConflict, codes.AlreadyExists},
+	{ErrFetchBlocked, websocket.ClosePolicyViolation, http.StatusForbidden, codes.PermissionDenied},
+	{ErrFetchFailed, websocket.CloseInternalServerErr, http.StatusBadGateway, codes.Unavailable},
+	{ErrInfected, websocket.ClosePolicyViolation, http.StatusUnprocessableEntity, codes.InvalidArgument},
+	{ErrScanFailed, websocket.CloseTryAgainLater, http.StatusServiceUnavailable, codes.Unavailable},
+	{core.ErrPoolFull, websocket.CloseTryAgainLater, http.StatusServiceUnavailable, codes.Unavailable},
+	{core.ErrPoolClosed, websocket.CloseGoingAway, http.StatusServiceUnavailable, codes.Unavailable},
+	{core.ErrMemoryLimit, websocket.CloseTryAgainLater, http.StatusServiceUnavailable, codes.Unavailable},
+}
+
+// closeCodeFor returns the close code of a client error.
+// The second return value is false for internal errors.
+func closeCodeFor(err error) (int, bool) {
+	for _, clientErr := range clientErrors {
+		if errors.Is(err, clientErr.err) {
+			return clientErr.closeCode, true
+		}
+	}
+	return 0, false
+}
+
+// statusFor returns the HTTP status code of a client error.
+// The second return value is false for internal errors.
+func statusFor(err error) (int, bool) {
+	for _, clientErr := range clientErrors {
+		if errors.Is(err, clientErr.err) {
+			return clientErr.status, true
+		}
+	}
+	return 0, false
+}
+
+// grpcCodeFor returns the gRPC status code of a client error.
+// The second return value is false for internal errors.
+func grpcCodeFor(err error) (codes.Code, bool) {
+	for _, clientErr := range clientErrors {
+		if errors.Is(err, clientErr.err) {
+			return clientErr.grpcCode, true
+		}
+	}
+	return codes.Internal, false
+}
+
+// clientError returns the description of an upload error that is safe to send to the client.
+func clientError(err error) string {
+	if _, ok := closeCodeFor(err); ok {
+		return err.Error()
+	}
+	return "upload failed"
+}
+
+// errorMessage returns the message that reports an upload error to the client.
+// Policy rejections are reported with their structured reason.
+func errorMessage(stream uint32, err error) ServerMessage {
+	var rejection *Rejection
+	if errors.As(err, &rejection) {
+		return ServerMessage{Stream: stream, Type: "rejected", Error: err.Error(), Reason: rejection}
+	}
+	return ServerMessage{Stream: stream, Type: "error", Error: clientError(err)}
+}
@@ -0,0 +1,33 @@
+package tasks
+
+import (
+	"net/http"
+	"time"
+)
+
+// DrainingMessage is the message that tells a connected client that the server is shutting down.
+// The client should finish its uploads and reconnect to another server for new ones.
+var DrainingMessage = ServerMessage{Type: "draining", Error: "server is shutting down"}
+
+// onDrain calls notify in its own goroutine once the drain channel is closed, unless stop has been called
+// before. A nil channel is never closed.
+func onDrain(drain <-chan struct{}, notify func()) (stop func()) {
+	if drain == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-drain:
+			notify()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// interruptRead interrupts a blocked read of the request body, so that a cancelled task stops reading.
+func interruptRead(w http.ResponseWriter) {
+	http.NewResponseController(w).SetReadDeadline(time.Now())
+}
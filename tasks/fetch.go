@@ -0,0 +1,158 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// ErrFetchBlocked is returned when the source URL of a fetch is not allowed,
+// e.g. because it points to a private network.
+var ErrFetchBlocked = errors.New("fetch blocked")
+
+// ErrFetchFailed is returned when the source of a fetch can't be downloaded.
+var ErrFetchFailed = errors.New("fetch failed")
+
+// FetchOptions are the limits of server-side fetches.
+type FetchOptions struct {
+	// Timeout is the maximum duration of a fetch including the upload, zero for unlimited.
+	Timeout time.Duration
+	// MaxRedirects is the maximum number of redirects that are followed.
+	MaxRedirects int
+	// MaxSize is the maximum size of a fetched file in bytes, zero for unlimited.
+	MaxSize int64
+	// AllowPrivateNetworks allows fetching from loopback, private and link-local addresses.
+	// It's meant for development only.
+	AllowPrivateNetworks bool
+}
+
+// blockedPrefixes are the special-purpose address ranges that are not covered by the methods of netip.Addr.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // TEST-NET-1
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // TEST-NET-2
+	netip.MustParsePrefix("203.0.113.0/24"),  // TEST-NET-3
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved and broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64, embeds IPv4 addresses
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use NAT64
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4, embeds IPv4 addresses
+}
+
+// publicAddress reports whether the address is a public unicast address.
+func publicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkFetchURL checks the scheme and the host of a source URL.
+// The addresses are checked when the connection is made, so redirects and DNS changes are covered as well.
+func checkFetchURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: unsupported scheme %q", ErrFetchBlocked, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("%w: host is missing", ErrFetchBlocked)
+	}
+	if u.User != nil {
+		return fmt.Errorf("%w: credentials in the URL are not allowed", ErrFetchBlocked)
+	}
+	return nil
+}
+
+// NewFetchClient creates the HTTP client of server-side fetches.
+// Every connection is checked against the blocked address ranges after the host has been resolved.
+func NewFetchClient(opts FetchOptions) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if opts.AllowPrivateNetworks {
+				return nil
+			}
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrFetchBlocked, err)
+			}
+			if !publicAddress(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s is not a public address", ErrFetchBlocked, addrPort.Addr())
+			}
+			return nil
+		},
+	}
+
+	transport := &http.Transport{
+		// A proxy would make the connections on behalf of the server, so the addresses couldn't be checked.
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > opts.MaxRedirects {
+				return fmt.Errorf("%w: more than %d redirects", ErrFetchBlocked, opts.MaxRedirects)
+			}
+			return checkFetchURL(req.URL)
+		},
+	}
+}
+
+// openFetch requests the source URL and returns the response if it's successful.
+func openFetch(ctx context.Context, client *http.Client, source string) (*http.Response, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid url", ErrInvalidUpload)
+	}
+	if err := checkFetchURL(u); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid url", ErrInvalidUpload)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// The URL is known to the client already.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		if errors.Is(err, ErrFetchBlocked) {
+			return nil, err
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%w: timed out", ErrFetchFailed)
+		}
+		return nil, fmt.Errorf("%w: %v", ErrFetchFailed, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: source responded with %s", ErrFetchFailed, resp.Status)
+	}
+
+	return resp, nil
+}
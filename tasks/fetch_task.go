@@ -0,0 +1,169 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/media_uploader/core"
+)
+
+// FetchRequest is the body of a server-side fetch.
+type FetchRequest struct {
+	// URL is the source of the file.
+	URL     string `json:"url"`
+	MediaId string `json:"mediaId"`
+	// MimeType overrides the Content-Type of the source.
+	MimeType string `json:"mimeType"`
+}
+
+// FetchUploadTask represents a task that downloads a file from a remote URL and uploads it to the storage.
+//
+// Errors that occur before the download starts are returned with a matching status code. Afterwards the
+// response is a stream of JSON lines: "accepted", "progress" messages as the data is received, and
+// finally "done" or "error".
+type FetchUploadTask struct {
+	task    core.Task
+	Writer  http.ResponseWriter
+	Request *http.Request
+	UploadOptions
+	Fetch FetchOptions
+	// Client is the HTTP client that downloads the source, see NewFetchClient.
+	Client *http.Client
+
+	// Done is closed when the response has been written.
+	Done chan struct{}
+}
+
+// Execute method implements the task execution logic for server-side fetches.
+func (t *FetchUploadTask) Execute() error {
+	return t.ExecuteContext(t.Request.Context())
+}
+
+// ExecuteContext executes the fetch with a context, which is passed to the source and the storage.
+func (t *FetchUploadTask) ExecuteContext(ctx context.Context) error {
+	defer close(t.Done)
+
+	var request FetchRequest
+	if err := json.NewDecoder(io.LimitReader(t.Request.Body, 64*1024)).Decode(&request); err != nil {
+		return t.fail(fmt.Errorf("%w: invalid request body", ErrInvalidUpload))
+	}
+
+	if t.Fetch.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Fetch.Timeout)
+		defer cancel()
+	}
+
+	resp, err := openFetch(ctx, t.Client, request.URL)
+	if err != nil {
+		core.LogWarning(fmt.Sprintf("Fetch of %q failed: %v", request.URL, err))
+		return t.fail(err)
+	}
+	defer resp.Body.Close()
+
+	firstChunk := FirstChunk{MimeType: request.MimeType, MediaId: request.MediaId}
+	if firstChunk.MimeType == "" {
+		firstChunk.MimeType = resp.Header.Get("Content-Type")
+	}
+	if resp.ContentLength > 0 {
+		firstChunk.Size = resp.ContentLength
+	}
+	if t.Fetch.MaxSize > 0 && firstChunk.Size > t.Fetch.MaxSize {
+		return t.fail(fmt.Errorf("%w: %d bytes declared, %d bytes allowed", ErrTooLarge, firstChunk.Size, t.Fetch.MaxSize))
+	}
+
+	info, err := describeUpload(firstChunk, t.UploadOptions)
+	if err != nil {
+		return t.fail(err)
+	}
+	info.sizeCap = t.Fetch.MaxSize
+	if err := info.limitSize(t.Limits); err != nil {
+		return t.fail(err)
+	}
+
+	return t.upload(ctx, info, resp.Body)
+}
+
+// upload streams the source to the storage and reports the progress.
+func (t *FetchUploadTask) upload(ctx context.Context, info uploadInfo, source io.Reader) error {
+	t.Writer.Header().Set("Content-Type", "application/x-ndjson")
+	t.Writer.WriteHeader(http.StatusOK)
+	t.send(ServerMessage{Type: "accepted", MediaId: info.mediaId})
+
+	session := newUploadSession(ctx, info, t.UploadOptions)
+
+	fail := func(err error) error {
+		session.Abort()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%w: timed out", ErrFetchFailed)
+		}
+		core.LogError("Error (while fetching video)", err)
+		t.send(errorMessage(0, err))
+		return err
+	}
+
+	var reported int64
+	buf := make([]byte, formReadSize)
+	for {
+		n, err := source.Read(buf)
+		if n > 0 {
+			if err := session.Write(buf[:n]); err != nil {
+				return fail(err)
+			}
+			if size := session.Size(); size-reported >= progressStep {
+				reported = size
+				t.send(ServerMessage{Type: "progress", Bytes: size})
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(fmt.Errorf("%w: %v", ErrFetchFailed, err))
+		}
+	}
+
+	loc, err := session.Complete()
+	if err != nil {
+		return fail(err)
+	}
+	core.LogInfo(fmt.Sprintf("Video fetched successfully. Location: %s", loc))
+
+	t.send(ServerMessage{Type: "done", MediaId: info.mediaId, Bytes: session.Size(), Location: loc})
+	return nil
+}
+
+// fail writes the error response before the download has started. Internal errors are not exposed.
+func (t *FetchUploadTask) fail(err error) error {
+	status, ok := statusFor(err)
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+
+	t.Writer.Header().Set("Content-Type", "application/json")
+	t.Writer.WriteHeader(status)
+	t.send(errorMessage(0, err))
+	return err
+}
+
+// Reject writes the response of a task that has not been accepted by the worker pool.
+func (t *FetchUploadTask) Reject(err error) {
+	defer close(t.Done)
+	t.fail(err)
+}
+
+// send writes a JSON line and flushes it to the client.
+func (t *FetchUploadTask) send(msg ServerMessage) {
+	if err := json.NewEncoder(t.Writer).Encode(msg); err != nil {
+		core.LogDebug(fmt.Sprintf("Failed to write response: %v", err))
+		return
+	}
+
+	if flusher, ok := t.Writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,151 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+
+	"github.com/media_uploader/core"
+)
+
+// formReadSize is the size of the chunks that are read from the request body.
+const formReadSize = 32 * 1024
+
+// FormUploadTask represents a task for a plain HTTP multipart/form-data upload.
+//
+// The form fields "mimeType", "mediaId" and "size" describe the upload like the first chunk of a stream upload,
+// and have to precede the "file" part, which is streamed to the storage without buffering the whole request.
+// The MIME type defaults to the Content-Type of the file part.
+type FormUploadTask struct {
+	task    core.Task
+	Writer  http.ResponseWriter
+	Request *http.Request
+	UploadOptions
+
+	// Done is closed when the response has been written.
+	Done chan struct{}
+}
+
+// Execute method implements the task execution logic for form uploads.
+func (t *FormUploadTask) Execute() error {
+	return t.ExecuteContext(context.Background())
+}
+
+// ExecuteContext executes the upload with a context, which is passed to the storage. When the context is done,
+// the request body is no longer read and the upload is aborted.
+func (t *FormUploadTask) ExecuteContext(ctx context.Context) error {
+	defer close(t.Done)
+
+	stop := context.AfterFunc(ctx, func() { interruptRead(t.Writer) })
+	defer stop()
+
+	reader, err := t.Request.MultipartReader()
+	if err != nil {
+		return t.fail(fmt.Errorf("%w: %v", ErrInvalidUpload, err))
+	}
+
+	var firstChunk FirstChunk
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return t.fail(fmt.Errorf("%w: file is missing", ErrInvalidUpload))
+		}
+		if err != nil {
+			return t.fail(fmt.Errorf("%w: %v", ErrInvalidUpload, err))
+		}
+
+		if part.FormName() != "file" {
+			if err := readFormField(part, &firstChunk); err != nil {
+				return t.fail(err)
+			}
+			continue
+		}
+
+		if firstChunk.MimeType == "" {
+			firstChunk.MimeType = part.Header.Get("Content-Type")
+		}
+
+		return t.upload(ctx, firstChunk, part)
+	}
+}
+
+// upload streams the file part to the storage and writes the result.
+func (t *FormUploadTask) upload(ctx context.Context, firstChunk FirstChunk, file io.Reader) error {
+	info, err := describeUpload(firstChunk, t.UploadOptions)
+	if err != nil {
+		return t.fail(err)
+	}
+
+	session := newUploadSession(ctx, info, t.UploadOptions)
+
+	if err := copyToSession(session, file); err != nil {
+		session.Abort()
+		core.LogError("Error (while reading form upload)", err)
+		return t.fail(err)
+	}
+
+	loc, err := session.Complete()
+	if err != nil {
+		core.LogError("Error (while uploading video)", err)
+		session.Abort()
+		return t.fail(err)
+	}
+	core.LogInfo(fmt.Sprintf("Video uploaded successfully. Location: %s", loc))
+
+	t.respond(http.StatusCreated, ServerMessage{Type: "done", MediaId: info.mediaId, Bytes: session.Size(), Location: loc})
+	return nil
+}
+
+// readFormField reads a form field that describes the upload.
+func readFormField(part *multipart.Part, firstChunk *FirstChunk) error {
+	value, err := io.ReadAll(io.LimitReader(part, 1024))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidUpload, err)
+	}
+
+	switch part.FormName() {
+	case "mimeType":
+		firstChunk.MimeType = string(value)
+	case "mediaId":
+		firstChunk.MediaId = string(value)
+	case "size":
+		firstChunk.Size, err = strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid size: %q", ErrInvalidUpload, value)
+		}
+	}
+
+	return nil
+}
+
+// fail writes the error response. Internal errors are not exposed.
+func (t *FormUploadTask) fail(err error) error {
+	status, ok := statusFor(err)
+	if !ok {
+		status = http.StatusInternalServerError
+	} else {
+		core.LogWarning(fmt.Sprintf("Upload rejected: %v", err))
+	}
+
+	t.respond(status, errorMessage(0, err))
+	return err
+}
+
+// Reject writes the response of a task that has not been accepted by the worker pool.
+func (t *FormUploadTask) Reject(err error) {
+	defer close(t.Done)
+	t.fail(err)
+}
+
+// respond writes a JSON response.
+func (t *FormUploadTask) respond(status int, msg ServerMessage) {
+	t.Writer.Header().Set("Content-Type", "application/json")
+	t.Writer.WriteHeader(status)
+	if err := json.NewEncoder(t.Writer).Encode(msg); err != nil {
+		core.LogDebug(fmt.Sprintf("Failed to write response: %v", err))
+	}
+}
@@ -0,0 +1,198 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/media_uploader/core"
+	"github.com/media_uploader/uploadpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GrpcUploadTask represents a task for an upload over the client-streaming gRPC Upload RPC.
+//
+// The first message of the stream carries the metadata of the upload like the first chunk of a stream upload,
+// the following ones carry the data. The response is sent once the client has closed the stream
+// and the file is stored.
+type GrpcUploadTask struct {
+	task   core.Task
+	Stream uploadpb.UploadService_UploadServer
+	UploadOptions
+
+	// Done receives the result of the RPC when the task has returned.
+	Done chan error
+}
+
+// grpcRequest is a message received from the stream, or the error of the receive.
+type grpcRequest struct {
+	request *uploadpb.UploadRequest
+	err     error
+}
+
+// Execute method implements the task execution logic for gRPC uploads.
+func (t *GrpcUploadTask) Execute() error {
+	return t.ExecuteContext(context.Background())
+}
+
+// ExecuteContext executes the upload with a context that also ends with the RPC. When the context is done,
+// the upload is aborted without waiting for the pending Recv, and the RPC returns with the status of
+// the cancellation. The RPC waits for the task, since the stream is only valid until it returns.
+func (t *GrpcUploadTask) ExecuteContext(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stop := context.AfterFunc(t.Stream.Context(), cancel)
+	defer stop()
+
+	err := t.upload(ctx, t.receive(ctx))
+	t.Done <- err
+	return err
+}
+
+// receive receives the messages of the stream until an error, or until the context is done.
+// A pending Recv ends when the RPC returns.
+func (t *GrpcUploadTask) receive(ctx context.Context) <-chan grpcRequest {
+	requests := make(chan grpcRequest)
+	go func() {
+		for {
+			request, err := t.Stream.Recv()
+			select {
+			case requests <- grpcRequest{request, err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return requests
+}
+
+// next returns the next message of the stream. The error of the context is returned when it's done first.
+func next(ctx context.Context, requests <-chan grpcRequest) (*uploadpb.UploadRequest, error) {
+	select {
+	case r := <-requests:
+		return r.request, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Reject returns the status of a task that has not been accepted by the worker pool to the RPC.
+func (t *GrpcUploadTask) Reject(err error) {
+	t.Done <- t.fail(err)
+}
+
+// upload receives the file from the stream and stores it.
+func (t *GrpcUploadTask) upload(ctx context.Context, requests <-chan grpcRequest) error {
+	request, err := next(ctx, requests)
+	if err != nil {
+		return t.interrupted(ctx, err)
+	}
+
+	metadata := request.GetMetadata()
+	if metadata == nil {
+		return t.fail(fmt.Errorf("%w: metadata has to be sent first", ErrInvalidUpload))
+	}
+
+	info, err := describeUpload(FirstChunk{
+		MimeType: metadata.MimeType,
+		MediaId:  metadata.MediaId,
+		Size:     metadata.Size,
+	}, t.UploadOptions)
+	if err != nil {
+		return t.fail(err)
+	}
+
+	session := newUploadSession(ctx, info, t.UploadOptions)
+
+	for {
+		request, err := next(ctx, requests)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if ctx.Err() != nil && t.Stream.Context().Err() == nil {
+				core.LogWarning(fmt.Sprintf("Upload cancelled: %s: %v", info.mediaId, err))
+				session.Abort()
+				return t.interrupted(ctx, err)
+			}
+
+			// The client has cancelled the RPC or the connection is lost.
+			core.LogError("Error (while reading gRPC upload)", err)
+			session.Cancel()
+			return err
+		}
+
+		chunk, ok := request.Payload.(*uploadpb.UploadRequest_Chunk)
+		if !ok {
+			session.Abort()
+			return t.fail(fmt.Errorf("%w: metadata has already been sent", ErrInvalidUpload))
+		}
+
+		if err := session.Write(chunk.Chunk); err != nil {
+			session.Abort()
+			return t.fail(err)
+		}
+	}
+
+	// Nothing is stored once the client has been told about the cancellation.
+	if ctx.Err() != nil {
+		session.Abort()
+		return t.interrupted(ctx, ctx.Err())
+	}
+
+	loc, err := session.Complete()
+	if err != nil {
+		core.LogError("Error (while uploading video)", err)
+		session.Abort()
+		if ctx.Err() != nil {
+			return t.interrupted(ctx, err)
+		}
+		return t.fail(err)
+	}
+	core.LogInfo(fmt.Sprintf("Video uploaded successfully. Location: %s", loc))
+
+	return t.Stream.SendAndClose(&uploadpb.UploadResponse{
+		MediaId:  info.mediaId,
+		Location: loc,
+		Size:     session.Size(),
+		Checksum: session.Checksum(),
+	})
+}
+
+// interrupted returns the result of an upload that has been interrupted by the error.
+// The status of the cancellation is returned if the task has been cancelled while the RPC is alive.
+func (t *GrpcUploadTask) interrupted(ctx context.Context, err error) error {
+	if ctx.Err() != nil && t.Stream.Context().Err() == nil {
+		return cancelledStatus(ctx.Err())
+	}
+	return err
+}
+
+// cancelledStatus returns the status of an upload whose task has been cancelled, e.g. after the task timeout
+// or on shutdown.
+func cancelledStatus(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return status.Error(codes.DeadlineExceeded, "upload timed out")
+	}
+	return status.Error(codes.Unavailable, "upload cancelled")
+}
+
+// fail returns the gRPC status of the error. Internal errors are not exposed.
+func (t *GrpcUploadTask) fail(err error) error {
+	code, ok := grpcCodeFor(err)
+	if ok {
+		core.LogWarning(fmt.Sprintf("Upload rejected: %v", err))
+	}
+
+	var rejection *Rejection
+	if errors.As(err, &rejection) {
+		return status.Error(code, fmt.Sprintf("%s: %s", rejection.Code, rejection.Message))
+	}
+	return status.Error(code, clientError(err))
+}
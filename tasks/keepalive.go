@@ -0,0 +1,150 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/media_uploader/core"
+)
+
+// KeepaliveOptions are the timeouts of a WebSocket connection. A zero value disables the timeout.
+type KeepaliveOptions struct {
+	// PingInterval is the interval of the pings that are sent to the client.
+	PingInterval time.Duration
+	// PongTimeout is the time the client has to answer a ping. Any message of the client counts as an answer.
+	PongTimeout time.Duration
+	// ReadTimeout is the maximum time between two messages of the client.
+	// It doesn't apply while the upload is paused, as long as the client answers the pings.
+	ReadTimeout time.Duration
+	// MaxDuration is the maximum duration of a connection.
+	MaxDuration time.Duration
+}
+
+// keepalive maintains the read deadline of a WebSocket connection and pings the client.
+// All methods except stop have to be called from the goroutine that reads the connection.
+type keepalive struct {
+	conn *websocket.Conn
+	opts KeepaliveOptions
+
+	start       time.Time
+	lastMessage time.Time
+	lastPong    time.Time
+	paused      bool
+
+	done chan struct{}
+}
+
+// startKeepalive sets the read deadline of the connection and starts pinging the client.
+func startKeepalive(conn *websocket.Conn, opts KeepaliveOptions) *keepalive {
+	now := time.Now()
+	k := &keepalive{
+		conn:        conn,
+		opts:        opts,
+		start:       now,
+		lastMessage: now,
+		lastPong:    now,
+		done:        make(chan struct{}),
+	}
+
+	conn.SetPongHandler(func(string) error {
+		k.lastPong = time.Now()
+		return k.refresh()
+	})
+	k.refresh()
+
+	if opts.PingInterval > 0 {
+		go k.ping()
+	}
+	return k
+}
+
+// ping sends a ping to the client every ping interval until the keepalive is stopped.
+func (k *keepalive) ping() {
+	ticker := time.NewTicker(k.opts.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-ticker.C:
+			// WriteControl can be called concurrently with the other write methods.
+			deadline := time.Now().Add(max(k.opts.PongTimeout, time.Second))
+			if err := k.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				core.LogDebug("Failed to write ping: " + err.Error())
+				return
+			}
+		}
+	}
+}
+
+// awaitMessage starts the read timeout of the next message. It's called before every read, so the time
+// that is spent processing a message (e.g. uploading a part) doesn't count.
+func (k *keepalive) awaitMessage() {
+	k.lastMessage = time.Now()
+	k.refresh()
+}
+
+// setPaused excludes the time of a paused upload from the read timeout. It takes effect with the next read.
+func (k *keepalive) setPaused(paused bool) {
+	k.paused = paused
+}
+
+// refresh sets the read deadline to the earliest of the timeouts.
+func (k *keepalive) refresh() error {
+	var deadline time.Time
+	earliest := func(t time.Time) {
+		if deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+
+	if k.opts.ReadTimeout > 0 && !k.paused {
+		earliest(k.lastMessage.Add(k.opts.ReadTimeout))
+	}
+	if k.opts.PingInterval > 0 && k.opts.PongTimeout > 0 {
+		alive := k.lastPong
+		if k.lastMessage.After(alive) {
+			alive = k.lastMessage
+		}
+		earliest(alive.Add(k.opts.PingInterval + k.opts.PongTimeout))
+	}
+	if k.opts.MaxDuration > 0 {
+		earliest(k.start.Add(k.opts.MaxDuration))
+	}
+
+	return k.conn.SetReadDeadline(deadline)
+}
+
+// stop stops pinging the client.
+func (k *keepalive) stop() {
+	close(k.done)
+}
+
+// expire closes the connection of a timed out session with the "going away" close code.
+func (k *keepalive) expire() {
+	deadline := time.Now().Add(time.Second)
+	k.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "Connection timed out"), deadline)
+}
+
+// closeCancelled closes the connection of a cancelled task with the "going away" close code.
+// It can be called concurrently with the goroutine that reads the connection.
+func closeCancelled(conn *websocket.Conn, err error) {
+	reason := "Upload cancelled"
+	if errors.Is(err, context.DeadlineExceeded) {
+		reason = "Upload timed out"
+	}
+
+	deadline := time.Now().Add(time.Second)
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, reason), deadline)
+	conn.Close()
+}
+
+// isTimeout reports whether a read error is caused by the read deadline.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,111 @@
+package tasks
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrTooLarge is returned when an upload exceeds its declared size or the maximum upload size.
+var ErrTooLarge = errors.New("upload exceeds the maximum size")
+
+// SizeLimits represents the maximum upload sizes. Zero means unlimited.
+type SizeLimits struct {
+	// Max is the global maximum upload size in bytes.
+	Max int64
+	// ByMimeType maps a MIME type ("video/mp4") or a wildcard ("video/*") to its maximum upload size in bytes.
+	ByMimeType map[string]int64
+}
+
+// limitFor returns the maximum upload size for the given MIME type.
+// The most specific limit wins: exact MIME type, then wildcard, then the global limit.
+func (l SizeLimits) limitFor(mimeType string) int64 {
+	mimeType = strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0]))
+
+	if limit, ok := l.ByMimeType[mimeType]; ok {
+		return limit
+	}
+
+	if i := strings.Index(mimeType, "/"); i >= 0 {
+		if limit, ok := l.ByMimeType[mimeType[:i]+"/*"]; ok {
+			return limit
+		}
+	}
+
+	return l.Max
+}
+
+// maxUploadSize returns the maximum number of bytes accepted for the upload described by the first chunk.
+// An error is returned if the declared size already exceeds the limit.
+func (l SizeLimits) maxUploadSize(firstChunk FirstChunk) (int64, error) {
+	if firstChunk.Size < 0 {
+		return 0, fmt.Errorf("%w: invalid size: %d", ErrInvalidUpload, firstChunk.Size)
+	}
+
+	limit := l.limitFor(firstChunk.MimeType)
+	if limit > 0 && firstChunk.Size > limit {
+		return 0, fmt.Errorf("%w: %d bytes declared, %d bytes allowed", ErrTooLarge, firstChunk.Size, limit)
+	}
+
+	// The declared size is the limit for the upload itself.
+	if firstChunk.Size > 0 {
+		return firstChunk.Size, nil
+	}
+	return limit, nil
+}
+
+// ParseSizeLimits parses a comma-separated list of MIME type and size pairs
+// like "video/*=2GB,image/png=20MB" into limits per MIME type.
+func ParseSizeLimits(value string) (map[string]int64, error) {
+	limits := make(map[string]int64)
+
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		mimeType, size, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid size limit: %q", pair)
+		}
+
+		limit, err := ParseByteSize(size)
+		if err != nil {
+			return nil, err
+		}
+		limits[strings.ToLower(strings.TrimSpace(mimeType))] = limit
+	}
+
+	return limits, nil
+}
+
+// ParseByteSize parses a size in bytes with an optional KB, MB or GB suffix (powers of 1024).
+func ParseByteSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"GB", 1024 * 1024 * 1024},
+		{"MB", 1024 * 1024},
+		{"KB", 1024},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size: %q", value)
+	}
+
+	return size * multiplier, nil
+}
@@ -0,0 +1,122 @@
+package tasks
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/media_uploader/auth"
+)
+
+// maxMediaIdLength is the maximum length of a client-supplied media id.
+const maxMediaIdLength = 128
+
+// mediaIdPattern matches the client-supplied media ids that are safe to use in file paths and object keys.
+var mediaIdPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// newMediaId generates a collision-resistant media id (UUIDv7).
+// The ids are ordered by creation time, which keeps the object keys of the storage roughly sorted.
+func newMediaId() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[6:]); err != nil {
+		return "", err
+	}
+
+	// 48 bits of Unix time in milliseconds
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(time.Now().UnixMilli()))
+	copy(id[:6], ms[2:])
+
+	// Version 7 and RFC 4122 variant
+	id[6] = (id[6] & 0x0f) | 0x70
+	id[8] = (id[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16]), nil
+}
+
+// validateMediaId checks a client-supplied media id. Only letters, digits, '_' and '-' are allowed,
+// so the id can't escape its directory or object key prefix.
+func validateMediaId(mediaId string) error {
+	if len(mediaId) > maxMediaIdLength {
+		return fmt.Errorf("media id is longer than %d characters", maxMediaIdLength)
+	}
+
+	if !mediaIdPattern.MatchString(mediaId) {
+		return fmt.Errorf("invalid media id: %q", mediaId)
+	}
+
+	return nil
+}
+
+// ValidateMediaIdPrefix checks a prefix of media ids, e.g. of an API key. The media ids that are generated
+// with the prefix have to be valid.
+func ValidateMediaIdPrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+
+	id, err := newMediaId()
+	if err != nil {
+		return err
+	}
+	if err := validateMediaId(prefix + id); err != nil {
+		return fmt.Errorf("invalid media id prefix: %q", prefix)
+	}
+	return nil
+}
+
+// resolveMediaId returns the media id of an upload. A new id is generated unless client-supplied ids are allowed
+// and the client has sent one.
+func resolveMediaId(clientMediaId string, allowClientMediaId bool) (string, error) {
+	if !allowClientMediaId || clientMediaId == "" {
+		return newMediaId()
+	}
+
+	if err := validateMediaId(clientMediaId); err != nil {
+		return "", err
+	}
+	return clientMediaId, nil
+}
+
+// resolveTicketMediaId returns the media id of an upload that is authorized by a ticket.
+// The media id of the ticket is used if it has one. Otherwise the client may choose an id that starts with
+// the prefix of the ticket if client-supplied ids are allowed, or a new id is generated and prefixed.
+func resolveTicketMediaId(clientMediaId string, ticket *auth.Ticket, allowClientMediaId bool) (string, error) {
+	if ticket.MediaId == "" {
+		return resolvePrefixedMediaId(clientMediaId, ticket.Prefix, allowClientMediaId)
+	}
+
+	if clientMediaId != "" && clientMediaId != ticket.MediaId {
+		return "", fmt.Errorf("media id %q is not allowed by the ticket", clientMediaId)
+	}
+	if err := validateMediaId(ticket.MediaId); err != nil {
+		return "", err
+	}
+	return ticket.MediaId, nil
+}
+
+// resolvePrefixedMediaId returns the media id of an upload that is restricted to a prefix.
+// A client-supplied id has to start with the prefix, otherwise a new id is generated and prefixed.
+func resolvePrefixedMediaId(clientMediaId, prefix string, allowClientMediaId bool) (string, error) {
+	var mediaId string
+	if allowClientMediaId && clientMediaId != "" {
+		if !strings.HasPrefix(clientMediaId, prefix) {
+			return "", fmt.Errorf("media id %q doesn't start with %q", clientMediaId, prefix)
+		}
+		mediaId = clientMediaId
+	} else {
+		id, err := newMediaId()
+		if err != nil {
+			return "", err
+		}
+		mediaId = prefix + id
+	}
+
+	if err := validateMediaId(mediaId); err != nil {
+		return "", err
+	}
+	return mediaId, nil
+}
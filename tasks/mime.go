@@ -0,0 +1,143 @@
+package tasks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// sniffLen is the number of leading bytes that are used to detect the content type.
+const sniffLen = 512
+
+// ErrTypeMismatch is returned when the content of an upload doesn't match its declared MIME type.
+var ErrTypeMismatch = errors.New("content doesn't match the declared mime type")
+
+// TypePolicy decides what happens when the detected content type doesn't match the declared MIME type.
+type TypePolicy string
+
+const (
+	// TypePolicyReject rejects the upload.
+	TypePolicyReject TypePolicy = "reject"
+	// TypePolicyCorrect replaces the declared MIME type with the detected one.
+	TypePolicyCorrect TypePolicy = "correct"
+	// TypePolicyTrust keeps the declared MIME type.
+	TypePolicyTrust TypePolicy = "trust"
+)
+
+// ParseTypePolicy parses the name of a type policy.
+func ParseTypePolicy(value string) (TypePolicy, error) {
+	switch policy := TypePolicy(strings.ToLower(value)); policy {
+	case TypePolicyReject, TypePolicyCorrect, TypePolicyTrust:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid type policy: %q", value)
+}
+
+// extensions maps the media types whose file extension differs from their subtype.
+var extensions = map[string]string{
+	"video/quicktime":  "mov",
+	"video/x-matroska": "mkv",
+	"video/x-msvideo":  "avi",
+	"audio/mpeg":       "mp3",
+	"audio/mp4":        "m4a",
+	"audio/wave":       "wav",
+	"image/svg+xml":    "svg",
+}
+
+// parseMimeType parses a MIME type with its parameters (e.g. "video/webm;codecs=h264").
+// The media type is returned in lower case.
+func parseMimeType(value string) (string, map[string]string, error) {
+	mediaType, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid mime type: %q", value)
+	}
+
+	typ, subtype, ok := strings.Cut(mediaType, "/")
+	if !ok || typ == "" || subtype == "" || typ == "*" || subtype == "*" {
+		return "", nil, fmt.Errorf("invalid mime type: %q", value)
+	}
+
+	return mediaType, params, nil
+}
+
+// extensionFor returns the file extension of a media type.
+func extensionFor(mediaType string) string {
+	if extension, ok := extensions[mediaType]; ok {
+		return extension
+	}
+
+	_, subtype, _ := strings.Cut(mediaType, "/")
+	subtype = strings.TrimPrefix(subtype, "x-")
+
+	// Drop structured syntax suffixes like "+xml".
+	subtype, _, _ = strings.Cut(subtype, "+")
+	return subtype
+}
+
+// sniffContentType detects the media type of the data from its leading bytes.
+// An empty string is returned if the type is unknown.
+func sniffContentType(data []byte) string {
+	switch {
+	case len(data) >= 12 && bytes.Equal(data[4:8], []byte("ftyp")):
+		return sniffISOBaseMedia(data[8:12])
+	case bytes.HasPrefix(data, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		// Matroska and WebM share the EBML header, the doctype tells them apart.
+		if bytes.Contains(data[:min(len(data), 64)], []byte("webm")) {
+			return "video/webm"
+		}
+		return "video/x-matroska"
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return "image/jpeg"
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "image/png"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return "image/gif"
+	case len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		return "image/webp"
+	case len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && bytes.Equal(data[8:12], []byte("AVI ")):
+		return "video/x-msvideo"
+	case bytes.HasPrefix(data, []byte("OggS")):
+		return "audio/ogg"
+	case bytes.HasPrefix(data, []byte("ID3")):
+		return "audio/mpeg"
+	}
+
+	// Fall back to the algorithm of the standard library for everything else.
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(data))
+	if err != nil || mediaType == "application/octet-stream" {
+		return ""
+	}
+	return mediaType
+}
+
+// sniffISOBaseMedia detects the media type of an ISO base media file (MP4, QuickTime, HEIF) from its major brand.
+func sniffISOBaseMedia(brand []byte) string {
+	switch string(brand) {
+	case "qt  ":
+		return "video/quicktime"
+	case "M4A ":
+		return "audio/mp4"
+	case "heic", "heix", "mif1", "msf1":
+		return "image/heic"
+	case "avif":
+		return "image/avif"
+	}
+	return "video/mp4"
+}
+
+// compatibleTypes reports whether the declared media type matches the detected one.
+// Audio and video variants of the same container (e.g. "audio/webm" and "video/webm") are compatible.
+func compatibleTypes(declared, detected string) bool {
+	if declared == detected {
+		return true
+	}
+
+	declaredType, declaredSubtype, _ := strings.Cut(declared, "/")
+	detectedType, detectedSubtype, _ := strings.Cut(detected, "/")
+	isAV := func(typ string) bool { return typ == "audio" || typ == "video" }
+
+	return declaredSubtype == detectedSubtype && isAV(declaredType) && isAV(detectedType)
+}
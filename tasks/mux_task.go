@@ -0,0 +1,355 @@
+package tasks
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"github.com/media_uploader/core"
+)
+
+// progressStep is the number of received bytes between two progress messages of a stream.
+const progressStep = 1024 * 1024
+
+// MuxUploadTask represents a task for several independent file uploads over one connection.
+//
+// Text messages are control frames (see MuxFrame). Binary messages carry the data of a stream:
+// the first 4 bytes are the big-endian stream id and the rest is the payload.
+type MuxUploadTask struct {
+	task core.Task
+	Conn *websocket.Conn
+	UploadOptions
+	// MaxStreams is the maximum number of streams that can be uploaded concurrently.
+	MaxStreams int
+
+	writeMu sync.Mutex
+	wg      sync.WaitGroup
+	slots   chan struct{}
+	streams map[uint32]*muxStream
+}
+
+// muxStream represents a single upload of a multiplexed connection.
+type muxStream struct {
+	id      uint32
+	session *uploadSession
+	data    chan []byte
+	// done is closed when the stream goroutine exits.
+	done chan struct{}
+	// finished is set before data is closed if the client has sent "eof".
+	finished bool
+	// cancelled is set if the client has sent "cancel".
+	cancelled atomic.Bool
+	// paused is set while the client has paused the stream. It only suspends the read timeout of the
+	// connection, see allPaused, data that is sent anyway is still taken.
+	paused bool
+	// expired is set before data is closed if the connection has timed out.
+	expired atomic.Bool
+}
+
+// Execute method implements the task execution logic for multiplexed file uploads.
+func (t *MuxUploadTask) Execute() error {
+	return t.ExecuteContext(context.Background())
+}
+
+// ExecuteContext executes the uploads with a context. When the context is done, the connection is closed
+// and the streams that haven't been finished are aborted.
+func (t *MuxUploadTask) ExecuteContext(ctx context.Context) error {
+	// Close the connection when the task execution is complete.
+	defer t.Conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { closeCancelled(t.Conn, ctx.Err()) })
+	defer stop()
+
+	stopDrain := onDrain(t.Drain, func() { t.send(DrainingMessage) })
+	defer stopDrain()
+
+	if t.MaxMessageSize > 0 {
+		t.Conn.SetReadLimit(t.MaxMessageSize)
+	}
+
+	maxStreams := t.MaxStreams
+	if maxStreams <= 0 {
+		maxStreams = 1
+	}
+	t.slots = make(chan struct{}, maxStreams)
+	t.streams = make(map[uint32]*muxStream)
+
+	keepalive := startKeepalive(t.Conn, t.Keepalive)
+	defer keepalive.stop()
+
+	for {
+		// The connection is idle without timing out while all of its streams are paused.
+		keepalive.setPaused(t.allPaused())
+		keepalive.awaitMessage()
+
+		messageType, message, err := t.Conn.ReadMessage()
+		if err != nil {
+			if isTimeout(err) {
+				core.LogWarning("Multiplexed connection timed out")
+				for _, s := range t.streams {
+					s.expired.Store(true)
+				}
+				t.closeStreams()
+				keepalive.expire()
+				return err
+			}
+
+			t.closeStreams()
+
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return nil
+			}
+			if ctx.Err() != nil {
+				core.LogWarning(fmt.Sprintf("Multiplexed connection cancelled: %v", ctx.Err()))
+				return ctx.Err()
+			}
+			return errors.New("socket has been closed - sync failed")
+		}
+
+		switch messageType {
+		case websocket.TextMessage:
+			t.handleFrame(ctx, message)
+		case websocket.BinaryMessage:
+			t.handleData(message)
+		}
+	}
+}
+
+// handleFrame handles a control frame. The sessions of new streams are derived from the context of the task.
+func (t *MuxUploadTask) handleFrame(ctx context.Context, message []byte) {
+	var frame MuxFrame
+	if err := json.Unmarshal(message, &frame); err != nil {
+		core.LogError("Error (while deserializing frame)", err)
+		t.send(ServerMessage{Type: "error", Error: "invalid frame"})
+		return
+	}
+
+	if frame.Stream == 0 {
+		t.send(ServerMessage{Type: "error", Error: "stream id is required"})
+		return
+	}
+
+	if frame.Type == "open" {
+		t.openStream(ctx, frame)
+		return
+	}
+
+	s, ok := t.streams[frame.Stream]
+	if !ok {
+		t.send(ServerMessage{Stream: frame.Stream, Type: "error", Error: "unknown stream"})
+		return
+	}
+
+	switch frame.Type {
+	case "eof":
+		s.finished = true
+		close(s.data)
+		delete(t.streams, frame.Stream)
+	case "cancel":
+		s.cancelled.Store(true)
+		close(s.data)
+		delete(t.streams, frame.Stream)
+
+		select {
+		case <-s.done:
+			// The stream has already failed, so there is nothing left to clean up.
+			t.send(ServerMessage{Stream: s.id, Type: "cancelled"})
+		default:
+		}
+	case "pause":
+		s.paused = true
+		t.send(ServerMessage{Stream: s.id, Type: "paused"})
+	case "resume":
+		s.paused = false
+		t.send(ServerMessage{Stream: s.id, Type: "resumed"})
+	default:
+		t.send(ServerMessage{Stream: frame.Stream, Type: "error", Error: fmt.Sprintf("unknown frame type: %q", frame.Type)})
+	}
+}
+
+// openStream handles the handshake of a new stream and starts its goroutine.
+func (t *MuxUploadTask) openStream(ctx context.Context, frame MuxFrame) {
+	if s, ok := t.streams[frame.Stream]; ok {
+		select {
+		case <-s.done:
+			// The stream has failed, so the id can be reused.
+			delete(t.streams, frame.Stream)
+		default:
+			t.send(ServerMessage{Stream: frame.Stream, Type: "error", Error: "stream is already open"})
+			return
+		}
+	}
+
+	info, err := describeUpload(frame.FirstChunk, t.UploadOptions)
+	if err != nil {
+		core.LogWarning(fmt.Sprintf("Stream %d rejected: %v", frame.Stream, err))
+		t.send(errorMessage(frame.Stream, err))
+		return
+	}
+
+	select {
+	case t.slots <- struct{}{}:
+	default:
+		t.send(ServerMessage{Stream: frame.Stream, Type: "error", Error: "too many concurrent streams"})
+		return
+	}
+
+	if !t.Uploads.AcquireUpTo(t.ClientKey, t.Claims.MaxConcurrentUploads()) {
+		<-t.slots
+		t.send(ThrottledMessage(frame.Stream, "too many concurrent uploads", t.Uploads.RetryAfter))
+		return
+	}
+
+	s := &muxStream{
+		id:      frame.Stream,
+		session: newUploadSession(ctx, info, t.UploadOptions),
+		data:    make(chan []byte, 16),
+		done:    make(chan struct{}),
+	}
+	t.streams[s.id] = s
+
+	t.wg.Add(1)
+	go t.runStream(s)
+
+	t.send(ServerMessage{Stream: s.id, Type: "opened", MediaId: info.mediaId})
+}
+
+// handleData passes a data frame to its stream.
+func (t *MuxUploadTask) handleData(message []byte) {
+	if len(message) < 4 {
+		t.send(ServerMessage{Type: "error", Error: "invalid data frame"})
+		return
+	}
+
+	id := binary.BigEndian.Uint32(message[:4])
+	s, ok := t.streams[id]
+	if !ok {
+		t.send(ServerMessage{Stream: id, Type: "error", Error: "unknown stream"})
+		return
+	}
+
+	select {
+	case s.data <- message[4:]:
+	case <-s.done:
+		// The stream has failed and the client has already been notified, so the data is dropped.
+	}
+}
+
+// runStream uploads the data of a stream and reports progress and the result to the client.
+func (t *MuxUploadTask) runStream(s *muxStream) {
+	defer t.wg.Done()
+	defer close(s.done)
+	defer func() {
+		t.Uploads.Release(t.ClientKey)
+		<-t.slots
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			core.LogWarning(fmt.Sprintf("Recovered from panic in stream goroutine: %v", r))
+			s.session.Abort()
+			t.send(ServerMessage{Stream: s.id, Type: "error", Error: "upload failed"})
+		}
+	}()
+
+	var err error
+	reported := int64(0)
+	for message := range s.data {
+		if s.cancelled.Load() || s.expired.Load() {
+			break
+		}
+
+		if err = s.session.Write(message); err != nil {
+			break
+		}
+
+		if size := s.session.Size(); size-reported >= progressStep {
+			reported = size
+			t.send(ServerMessage{Stream: s.id, Type: "progress", Bytes: size})
+		}
+	}
+
+	if s.expired.Load() {
+		// A timed out stream is gone for good, so its temporary file is removed as well.
+		s.session.Cancel()
+		t.send(ServerMessage{Stream: s.id, Type: "error", Error: "connection timed out"})
+		return
+	}
+
+	if s.cancelled.Load() {
+		s.session.Cancel()
+		core.LogInfo(fmt.Sprintf("Stream %d cancelled by the client", s.id))
+		t.send(ServerMessage{Stream: s.id, Type: "cancelled"})
+		return
+	}
+
+	if err == nil && !s.finished {
+		err = errors.New("stream closed before eof")
+	}
+
+	if err != nil {
+		core.LogError(fmt.Sprintf("Error (while uploading stream %d)", s.id), err)
+		s.session.Abort()
+
+		t.send(errorMessage(s.id, err))
+		return
+	}
+
+	loc, err := s.session.Complete()
+	if err != nil {
+		core.LogError(fmt.Sprintf("Error (while completing stream %d)", s.id), err)
+		s.session.Abort()
+		t.send(errorMessage(s.id, err))
+		return
+	}
+	core.LogInfo(fmt.Sprintf("Video uploaded successfully. Location: %s", loc))
+
+	t.send(ServerMessage{Stream: s.id, Type: "done", Bytes: s.session.Size(), Location: loc})
+}
+
+// allPaused reports whether the connection has open streams and all of them are paused.
+func (t *MuxUploadTask) allPaused() bool {
+	for _, s := range t.streams {
+		if !s.paused {
+			return false
+		}
+	}
+	return len(t.streams) > 0
+}
+
+// closeStreams aborts the streams that haven't been finished and waits for all streams to exit.
+func (t *MuxUploadTask) closeStreams() {
+	for id, s := range t.streams {
+		close(s.data)
+		delete(t.streams, id)
+	}
+	t.wg.Wait()
+}
+
+// Reject reports that the task has not been accepted by the worker pool and closes the connection.
+func (t *MuxUploadTask) Reject(err error) {
+	defer t.Conn.Close()
+
+	code, ok := closeCodeFor(err)
+	if !ok {
+		code = websocket.CloseInternalServerErr
+	}
+	core.LogWarning(fmt.Sprintf("Connection rejected: %v", err))
+	t.send(errorMessage(0, err))
+	t.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, "Connection rejected"))
+}
+
+// send writes a message to the client. Writes are serialized since the connection
+// supports only one concurrent writer.
+func (t *MuxUploadTask) send(msg ServerMessage) {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+
+	if err := t.Conn.WriteJSON(msg); err != nil {
+		core.LogDebug(fmt.Sprintf("Failed to write message: %v", err))
+	}
+}
@@ -0,0 +1,163 @@
+package tasks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/media_uploader/quota"
+)
+
+// ErrRejected is returned when an upload is not admitted by the upload policy.
+var ErrRejected = errors.New("upload rejected by policy")
+
+// Rejection codes of the upload policy.
+const (
+	RejectTypeNotAllowed      = "type_not_allowed"
+	RejectExtensionNotAllowed = "extension_not_allowed"
+	RejectSizeRequired        = "size_required"
+	RejectTooSmall            = "too_small"
+	RejectTooLarge            = "too_large"
+	RejectQuotaExceeded       = "quota_exceeded"
+)
+
+// Rejection is the structured reason of a rejected upload that is sent to the client.
+type Rejection struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error implements the error interface.
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("%v: %s", ErrRejected, r.Message)
+}
+
+// Unwrap makes the rejection match ErrRejected.
+func (r *Rejection) Unwrap() error {
+	return ErrRejected
+}
+
+// quotaRejection turns an exceeded quota into a rejection, so it's reported like a policy violation.
+// Other errors are returned unchanged.
+func quotaRejection(err error) error {
+	if errors.Is(err, quota.ErrQuotaExceeded) {
+		return &Rejection{Code: RejectQuotaExceeded, Message: err.Error()}
+	}
+	return err
+}
+
+// Policy decides which uploads are admitted. The zero value admits everything.
+type Policy struct {
+	// AllowedTypes are the allowed media types. Wildcards like "video/*" are supported.
+	// An empty list allows every type.
+	AllowedTypes []string `json:"allowedTypes,omitempty"`
+	// AllowedExtensions are the allowed file extensions without the dot.
+	// An empty list allows every extension.
+	AllowedExtensions []string `json:"allowedExtensions,omitempty"`
+	// RequireSize requires the client to declare the size of the upload.
+	RequireSize bool `json:"requireSize,omitempty"`
+	// MinSize is the minimum size of an upload in bytes.
+	MinSize int64 `json:"minSize,omitempty"`
+	// MaxSize is the maximum size of an upload in bytes, zero for unlimited.
+	MaxSize int64 `json:"maxSize,omitempty"`
+}
+
+// PolicyConfig holds the upload policies. An upload has to be admitted by the default policy,
+// the policy of its endpoint and the policy of its tenant.
+type PolicyConfig struct {
+	Default Policy `json:"default"`
+	// Endpoints maps an endpoint name (e.g. "upload_stream") to its policy.
+	Endpoints map[string]Policy `json:"endpoints,omitempty"`
+	// Tenants maps a tenant to its policy.
+	Tenants map[string]Policy `json:"tenants,omitempty"`
+}
+
+// LoadPolicyConfig loads the upload policies from a JSON file.
+func LoadPolicyConfig(path string) (*PolicyConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config PolicyConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+
+	return &config, nil
+}
+
+// policiesFor returns the policies that apply to an upload of the endpoint and the tenant.
+func (c *PolicyConfig) policiesFor(endpoint, tenant string) []Policy {
+	if c == nil {
+		return nil
+	}
+
+	policies := []Policy{c.Default}
+	if policy, ok := c.Endpoints[endpoint]; ok {
+		policies = append(policies, policy)
+	}
+	if policy, ok := c.Tenants[tenant]; ok && tenant != "" {
+		policies = append(policies, policy)
+	}
+	return policies
+}
+
+// admitType checks the media type and its file extension.
+func (p Policy) admitType(mediaType, extension string) *Rejection {
+	if len(p.AllowedTypes) > 0 && !matchesMediaType(p.AllowedTypes, mediaType) {
+		return &Rejection{Code: RejectTypeNotAllowed, Message: fmt.Sprintf("media type %s is not allowed", mediaType)}
+	}
+
+	if len(p.AllowedExtensions) > 0 && !containsFold(p.AllowedExtensions, extension) {
+		return &Rejection{Code: RejectExtensionNotAllowed, Message: fmt.Sprintf("extension %s is not allowed", extension)}
+	}
+
+	return nil
+}
+
+// admitDeclaredSize checks the size declared at handshake time.
+func (p Policy) admitDeclaredSize(size int64) *Rejection {
+	if p.RequireSize && size == 0 {
+		return &Rejection{Code: RejectSizeRequired, Message: "size of the upload is required"}
+	}
+	if size > 0 {
+		return p.admitSize(size)
+	}
+	return nil
+}
+
+// admitSize checks the size of the upload.
+func (p Policy) admitSize(size int64) *Rejection {
+	if size < p.MinSize {
+		return &Rejection{Code: RejectTooSmall, Message: fmt.Sprintf("upload is smaller than %d bytes", p.MinSize)}
+	}
+	if p.MaxSize > 0 && size > p.MaxSize {
+		return &Rejection{Code: RejectTooLarge, Message: fmt.Sprintf("upload is larger than %d bytes", p.MaxSize)}
+	}
+	return nil
+}
+
+// matchesMediaType reports whether the media type matches one of the patterns.
+func matchesMediaType(patterns []string, mediaType string) bool {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*/*" || pattern == mediaType || pattern == typ+"/*" {
+			return true
+		}
+	}
+	return false
+}
+
+// containsFold reports whether the list contains the value, ignoring case.
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,216 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/media_uploader/core"
+	"github.com/media_uploader/scan"
+)
+
+// ErrInfected is returned when malware is found in an upload.
+var ErrInfected = errors.New("upload is infected")
+
+// ErrScanFailed is returned when an upload can't be scanned.
+var ErrScanFailed = errors.New("malware scan failed")
+
+// errScanCancelled stops the scan of a discarded upload.
+var errScanCancelled = errors.New("scan cancelled")
+
+// ScanOptions are the settings of the malware scans.
+type ScanOptions struct {
+	// Scanner scans the uploads before they are stored, nil disables scanning.
+	Scanner scan.Scanner
+	// Spooled scans the temporary file once the upload is received instead of the streamed bytes.
+	// It requires the temporary saving of the uploads.
+	Spooled bool
+	// Quarantine stores infected uploads under the QuarantinePrefix instead of discarding them.
+	Quarantine       bool
+	QuarantinePrefix string
+}
+
+// scanResult is the verdict of a scan.
+type scanResult struct {
+	result scan.Result
+	err    error
+}
+
+// streamScan scans the bytes of an upload while they arrive.
+type streamScan struct {
+	writer *io.PipeWriter
+	result chan scanResult
+}
+
+// startScan starts the scan of the streamed bytes.
+func startScan(ctx context.Context, scanner scan.Scanner) *streamScan {
+	reader, writer := io.Pipe()
+	s := &streamScan{writer: writer, result: make(chan scanResult, 1)}
+
+	go func() {
+		result, err := scanner.Scan(ctx, reader)
+		// Writers must not block if the scanner has stopped reading.
+		reader.CloseWithError(errScanCancelled)
+		s.result <- scanResult{result: result, err: err}
+	}()
+
+	return s
+}
+
+// write passes the received data to the scanner.
+func (s *streamScan) write(data []byte) error {
+	_, err := s.writer.Write(data)
+	return err
+}
+
+// finish ends the stream and waits for the verdict.
+func (s *streamScan) finish() (scan.Result, error) {
+	s.writer.Close()
+	result := <-s.result
+	return result.result, result.err
+}
+
+// cancel stops the scan without waiting for it.
+func (s *streamScan) cancel() {
+	s.writer.CloseWithError(errScanCancelled)
+}
+
+// scanData passes the received data to the scan of the streamed bytes, which is started with the first data.
+func (s *uploadSession) scanData(data []byte) error {
+	if s.opts.Scan.Scanner == nil || s.spooledScan() {
+		return nil
+	}
+
+	if s.scan == nil {
+		s.scan = startScan(s.base, s.opts.Scan.Scanner)
+	}
+
+	if err := s.scan.write(data); err != nil {
+		// The scanner has stopped, its error is the reason unless it has none.
+		if _, scanErr := s.scan.finish(); scanErr != nil {
+			err = scanErr
+		}
+		s.scan = nil
+		return fmt.Errorf("%w: %v", ErrScanFailed, err)
+	}
+	return nil
+}
+
+// spooledScan reports whether the temporary file is scanned instead of the streamed bytes.
+func (s *uploadSession) spooledScan() bool {
+	return s.opts.Scan.Spooled && s.opts.SaveUploadsTemporarily
+}
+
+// verdict waits for the scan of the upload before it's stored. Infected uploads are quarantined
+// if it's enabled, and ErrInfected is returned.
+func (s *uploadSession) verdict() error {
+	if s.opts.Scan.Scanner == nil {
+		return nil
+	}
+
+	var result scan.Result
+	var err error
+	if s.spooledScan() {
+		result, err = s.scanTempFile()
+	} else {
+		if s.scan == nil {
+			s.scan = startScan(s.base, s.opts.Scan.Scanner)
+		}
+		result, err = s.scan.finish()
+		s.scan = nil
+	}
+	if err != nil {
+		core.LogError(fmt.Sprintf("Error (while scanning %s)", s.info.mediaId), err)
+		return fmt.Errorf("%w: %v", ErrScanFailed, err)
+	}
+
+	if !result.Infected {
+		return nil
+	}
+
+	core.LogWarning(fmt.Sprintf("Malware %s found in %s", result.Signature, s.info.mediaId))
+	if s.opts.Scan.Quarantine {
+		s.quarantine()
+	}
+
+	// The infected data must not be left in the temporary folder.
+	if s.tempPath != "" {
+		os.Remove(s.tempPath)
+		s.tempPath = ""
+	}
+	return fmt.Errorf("%w: %s", ErrInfected, result.Signature)
+}
+
+// scanTempFile scans the temporary file of the upload.
+func (s *uploadSession) scanTempFile() (scan.Result, error) {
+	file, err := os.Open(s.tempPath)
+	if err != nil {
+		return scan.Result{}, err
+	}
+	defer file.Close()
+
+	return s.opts.Scan.Scanner.Scan(s.ctx, file)
+}
+
+// quarantine stores an infected upload under the quarantine prefix. A multipart upload is aborted and
+// stored again from the temporary file, so it can only be quarantined if the upload has been saved temporarily.
+func (s *uploadSession) quarantine() {
+	fileName := s.opts.Scan.QuarantinePrefix + s.info.fileName()
+
+	var loc string
+	var err error
+	if s.multipart == nil {
+		loc, err = s.backend().DirectUpload(s.ctx, s.info.contentType(), fileName, s.buffer)
+	} else {
+		s.multipart.Abort(s.ctx)
+		s.multipart = nil
+
+		if s.tempPath == "" {
+			core.LogWarning(fmt.Sprintf("Infected upload %s discarded, it has not been saved temporarily", s.info.mediaId))
+			return
+		}
+		loc, err = s.uploadTempFile(fileName)
+	}
+	if err != nil {
+		core.LogError(fmt.Sprintf("Error (while quarantining %s)", s.info.mediaId), err)
+		return
+	}
+
+	core.LogWarning(fmt.Sprintf("Infected upload %s quarantined at %s", s.info.mediaId, loc))
+}
+
+// uploadTempFile uploads the temporary file in parts under another file name.
+func (s *uploadSession) uploadTempFile(fileName string) (string, error) {
+	file, err := os.Open(s.tempPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	multipart, err := s.backend().StartMultipart(s.ctx, s.info.contentType(), fileName)
+	if err != nil {
+		return "", err
+	}
+
+	part := make([]byte, partSize)
+	for partNumber := int32(1); ; partNumber++ {
+		n, err := io.ReadFull(file, part)
+		if n > 0 {
+			if err := multipart.UploadPart(s.ctx, partNumber, part[:n]); err != nil {
+				multipart.Abort(s.ctx)
+				return "", err
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			multipart.Abort(s.ctx)
+			return "", err
+		}
+	}
+
+	return multipart.Complete(s.ctx)
+}
@@ -4,46 +4,57 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"os"
-	"strings"
 	"sync"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/gorilla/websocket"
-	uploader "github.com/media_uploader/amazon"
 	"github.com/media_uploader/core"
 )
 
 // StreamUploadTask represents a task for streaming file uploads.
 type StreamUploadTask struct {
-	task                   core.Task
-	Conn                   *websocket.Conn
-	SaveUploadsTemporarily bool
+	task core.Task
+	Conn *websocket.Conn
+	UploadOptions
 
 	// Add mutex to protect shared resources
 	mu sync.Mutex
+	// writeMu serializes the writes, since the drain notice is sent by another goroutine.
+	writeMu sync.Mutex
 }
 
 // Execute method implements the task execution logic for streaming file uploads.
 func (t *StreamUploadTask) Execute() error {
+	return t.ExecuteContext(context.Background())
+}
+
+// ExecuteContext executes the upload with a context, which is passed to the storage. When the context is done,
+// the connection is closed and the upload is aborted.
+func (t *StreamUploadTask) ExecuteContext(ctx context.Context) error {
 	// Close the connection when the task execution is complete.
 	defer t.Conn.Close()
 
-	// Create a 'temp' folder if it does not exist.
-	if t.SaveUploadsTemporarily {
-		_, err := os.Stat("temp")
-		if os.IsNotExist(err) {
-			errDir := os.Mkdir("temp", 0755)
-			if errDir != nil {
-				fmt.Println("Error:", errDir, "not critical. It keeps going.")
-			}
-		}
+	stop := context.AfterFunc(ctx, func() { closeCancelled(t.Conn, ctx.Err()) })
+	defer stop()
+
+	stopDrain := onDrain(t.Drain, func() { t.writeJSON(DrainingMessage) })
+	defer stopDrain()
+
+	if t.MaxMessageSize > 0 {
+		t.Conn.SetReadLimit(t.MaxMessageSize)
 	}
 
+	keepalive := startKeepalive(t.Conn, t.Keepalive)
+	defer keepalive.stop()
+
 	// Read first chunk for video data
 	_, data, err := t.Conn.ReadMessage()
 	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if isTimeout(err) {
+			keepalive.expire()
+		}
 		core.LogError("Error (while reading first chunk)", err)
 		return err
 	}
@@ -55,68 +66,44 @@ func (t *StreamUploadTask) Execute() error {
 		return err
 	}
 
-	// Extract the MIME type from the first chunk
-	mimeType := strings.Split(firstChunk.MimeType, "/")[1]
-
-	// Extansion for video
-	extension := strings.Split(mimeType, ";")[0]
-
-	// Generate a unique filename using UUID.
-	uniqueFileName := firstChunk.MediaId
-	fileName := uniqueFileName + "." + extension
-
-	// Create a binary file to store the uploaded data.
-	var binaryFile *os.File
-
-	// Create a binary file to store the uploaded data.
-	if t.SaveUploadsTemporarily {
-		binaryFile, err = os.Create("temp/" + fileName)
-		if err != nil {
-			core.LogError("Error (while creating binary file)", err)
-			return err
-		}
-		defer binaryFile.Close()
+	info, err := describeUpload(firstChunk, t.UploadOptions)
+	if err != nil {
+		return t.fail(err)
 	}
 
-	context := context.Background()
-
 	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	var completedParts = make([]types.CompletedPart, 0)
-	var eTags = make([]string, 0)
-	var partNumber int32 = 1
-	var loc string = ""
-	var svc *s3.Client
-	var resp *s3.CreateMultipartUploadOutput
+	session := newUploadSession(ctx, info, t.UploadOptions)
 
-	var buffer []byte
-	var directUploadFlag bool = true
-	var multipartUploadFlag bool = false
+	// Let the client know the media id of the upload.
+	t.writeJSON(ServerMessage{Type: "accepted", MediaId: info.mediaId})
 
 	// Read and write data in chunks until "EOF" is received.
 	for {
-		_, message, err := t.Conn.ReadMessage()
+		keepalive.awaitMessage()
+		messageType, message, err := t.Conn.ReadMessage()
 		if err != nil {
 			// Handle normal closure, check file size, and cleanup if necessary.
 			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
 				break
 			}
 
-			if t.SaveUploadsTemporarily {
-				// Check file size
-				stat, err := os.Stat("temp/" + fileName)
-				if err != nil {
-					core.LogError("Error (while checking file size)", err)
-					return err
-				}
+			if ctx.Err() != nil {
+				core.LogWarning(fmt.Sprintf("Upload cancelled: %s: %v", info.mediaId, ctx.Err()))
+				session.Abort()
+				return ctx.Err()
+			}
 
-				// Check file size <1kb, remove incomplete file if true.
-				if stat.Size() < 1024 {
-					os.Remove("temp/" + fileName)
-					return nil
-				}
+			// A timed out session is gone for good, so its temporary file is removed as well.
+			if isTimeout(err) {
+				core.LogWarning(fmt.Sprintf("Upload timed out: %s", info.mediaId))
+				session.Cancel()
+				keepalive.expire()
+				return err
 			}
 
+			session.Abort()
 			return errors.New("socket has been closed - sync failed")
 		}
 
@@ -125,100 +112,102 @@ func (t *StreamUploadTask) Execute() error {
 			break
 		}
 
-		// Write the received data to the binary file.
-		if t.SaveUploadsTemporarily {
-			_, err = binaryFile.Write(message)
-			if err != nil {
-				core.LogError("Error (while writing to binary file)", err)
-				return err
+		// Handle control messages of the client.
+		if messageType == websocket.TextMessage {
+			if frame, ok := parseControlFrame(message); ok {
+				switch frame.Type {
+				case "cancel":
+					session.Cancel()
+					core.LogInfo(fmt.Sprintf("Upload cancelled by the client: %s", info.mediaId))
+					return t.finish(ServerMessage{Type: "cancelled"}, "Upload cancelled")
+				case "pause":
+					// Pausing only suspends the read timeout, data that is sent anyway is still taken.
+					keepalive.setPaused(true)
+					t.writeJSON(ServerMessage{Type: "paused", Bytes: session.Size()})
+				case "resume":
+					keepalive.setPaused(false)
+					t.writeJSON(ServerMessage{Type: "resumed", Bytes: session.Size()})
+				}
+				continue
 			}
 		}
 
-		buffer = append(buffer, message...)
-
-		// NOTE: Amazon S3 mandates a minimum part size of 5 MB for multipart uploads.
-		// Our approach is to upload in 5 MB parts if the buffer size exceeds this threshold.
-		// Otherwise, we upload the data in a single part.
-		// However, this strategy imposes a 50 GB upper limit (5 * 10000 MiB) on the data size
-		// due to the minimum part size.
-		// In a scenario where 200 users upload <5 MB data (e.g., 3 MB each) and 800 users upload >5 MB data (e.g., 250 MB each),
-		// the calculated RAM usage for 1000 connections is as follows:
-		// (3 * 100) MB + (800 * 5) MB = ~4.3 GB.
-		// It's important to note that Goroutines have different lifetimes, and during processing,
-		// some reserved memory will be released by the Go garbage collector,
-		// especially when handling smaller uploads like the <5MB MB example.
-		// R2 does not supported the different non-trailing part sizes for multipart uploads like AWS S3.
-		// So we have to be sure that every part is exactly 5 MB.
-		if len(buffer) >= (1024*1024)*5 {
-			if !multipartUploadFlag {
-				svc, resp, err = uploader.StreamUploadInit(&context, mimeType, fileName)
-				if err != nil {
-					core.LogError("Error (while initializing multipart upload)", err)
-					return err
-				}
-				multipartUploadFlag = true
-				directUploadFlag = false
-			}
+		if err := session.Write(message); err != nil {
+			session.Abort()
+			return t.fail(err)
+		}
+	}
 
-			first5MbOfBuffer := buffer[:5*1024*1024]
-			// remove first 5 MB from buffer for next 5 MB
-			buffer = buffer[5*1024*1024:]
-			uploadResult, err := uploader.StreamUpload(&context, svc, resp, first5MbOfBuffer, partNumber)
-			if err != nil {
-				core.LogError("Error (while uploading part): %s", err)
-				return err
-			}
+	loc, err := session.Complete()
+	if err != nil {
+		core.LogError("Error (while uploading video)", err)
+		session.Abort()
+		return t.fail(err)
+	}
+	core.LogInfo(fmt.Sprintf("Video uploaded successfully. Location: %s", loc))
 
-			var numb int32 = int32(partNumber)
-			completedParts = append(completedParts, types.CompletedPart{
-				ETag:       uploadResult.ETag,
-				PartNumber: &numb,
-			})
+	err = t.writeMessage(websocket.TextMessage, []byte(loc))
+	if err != nil {
+		core.LogError("Error (while sending location)", err)
+		return err
+	}
 
-			partNumber += 1
-		}
+	// Send a WebSocket close message.
+	err = t.writeMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Upload completed"))
+	if err != nil {
+		core.LogError("Error (while closing connection)", err)
+		return err
 	}
 
-	if !directUploadFlag && multipartUploadFlag {
-		// Check completed parts tag and part number
-		if len(eTags) > 0 {
-			for i := 0; i < len(eTags); i++ {
-				core.LogInfo("======  ETags ======")
-				core.LogInfo(fmt.Sprintf("ETag: %s", eTags[i]))
-				core.LogInfo(fmt.Sprintf("Part number: %d", completedParts[i].PartNumber))
-				core.LogInfo("====== !ETags ======")
-			}
-		}
+	return nil
+}
 
-		loc, err = uploader.StreamDone(&context, svc, resp, completedParts)
-		if err != nil {
-			fmt.Println(err)
-			return err
-		}
-		core.LogInfo(fmt.Sprintf("Video uploaded successfully. Location: %s", loc))
-	} else if directUploadFlag {
-		loc, err = uploader.DirectUpload(&context, mimeType, fileName, buffer)
-		if err != nil {
-			fmt.Println(err)
-			return err
-		}
-		core.LogInfo(fmt.Sprintf("Video uploaded successfully. Location: %s", loc))
-	} else {
-		core.LogError("Error (while uploading video): %s", errors.New("failed to upload video"))
+// fail reports a client error to the client and closes the connection with its close code.
+// The error is returned to the caller.
+func (t *StreamUploadTask) fail(err error) error {
+	code, ok := closeCodeFor(err)
+	if !ok {
+		return err
 	}
 
-	t.mu.Unlock()
+	core.LogWarning(fmt.Sprintf("Upload rejected: %v", err))
+	t.writeJSON(errorMessage(0, err))
+	t.writeMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, "Upload rejected"))
+	return err
+}
+
+// Reject reports that the task has not been accepted by the worker pool and closes the connection.
+func (t *StreamUploadTask) Reject(err error) {
+	t.fail(err)
+	t.Conn.Close()
+}
+
+// writeJSON writes a JSON message to the client.
+func (t *StreamUploadTask) writeJSON(v interface{}) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	return t.Conn.WriteJSON(v)
+}
+
+// writeMessage writes a message to the client.
+func (t *StreamUploadTask) writeMessage(messageType int, data []byte) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	return t.Conn.WriteMessage(messageType, data)
+}
 
-	err = t.Conn.WriteMessage(websocket.TextMessage, []byte(loc))
+// finish sends the final message and closes the connection normally with the given reason.
+func (t *StreamUploadTask) finish(msg ServerMessage, reason string) error {
+	err := t.writeJSON(msg)
 	if err != nil {
-		fmt.Println(err)
+		core.LogError("Error (while sending final message)", err)
 		return err
 	}
 
 	// Send a WebSocket close message.
-	err = t.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Upload completed"))
+	err = t.writeMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason))
 	if err != nil {
-		fmt.Println(err)
+		core.LogError("Error (while closing connection)", err)
 		return err
 	}
 
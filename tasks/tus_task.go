@@ -0,0 +1,503 @@
+package tasks
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/media_uploader/auth"
+	"github.com/media_uploader/core"
+)
+
+// Headers and values of the tus resumable upload protocol (https://tus.io/protocols/resumable-upload).
+const (
+	TusVersion            = "1.0.0"
+	TusExtensions         = "creation,termination,checksum"
+	TusChecksumAlgorithms = "sha1,md5,sha256"
+
+	// tusStatusChecksumMismatch is the status code of a PATCH request whose checksum doesn't match.
+	tusStatusChecksumMismatch = 460
+)
+
+// TusStore keeps the state of the tus uploads. Every tus upload is an upload session,
+// so the data goes through the same part upload pipeline as the WebSocket uploads.
+type TusStore struct {
+	UploadOptions
+	// BasePath is the URL path that the upload ids are appended to (e.g. "/files/").
+	BasePath string
+	// Expiration is the time after which an idle upload is aborted.
+	Expiration time.Duration
+
+	mu      sync.Mutex
+	uploads map[string]*tusUpload
+}
+
+// tusUpload represents a tus upload. The mutex is held while the upload is modified.
+type tusUpload struct {
+	mu       sync.Mutex
+	session  *uploadSession
+	length   int64
+	location string
+	// lastActive is the time of the last request, guarded by the mutex of the store.
+	lastActive time.Time
+	// owner is the subject of the client that has created the upload, empty without authentication.
+	owner string
+}
+
+// NewTusStore creates an empty TusStore.
+func NewTusStore(opts UploadOptions, basePath string, expiration time.Duration) *TusStore {
+	return &TusStore{
+		UploadOptions: opts,
+		BasePath:      basePath,
+		Expiration:    expiration,
+		uploads:       make(map[string]*tusUpload),
+	}
+}
+
+// Options describes the capabilities of the server.
+func (s *TusStore) Options(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", TusVersion)
+	w.Header().Set("Tus-Extension", TusExtensions)
+	w.Header().Set("Tus-Checksum-Algorithm", TusChecksumAlgorithms)
+	if s.Limits.Max > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(s.Limits.Max, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Create creates a new upload (creation extension). The upload is described by the
+// Upload-Length header and the "filetype" (or "mimeType") and "mediaId" keys of the Upload-Metadata header.
+// The options are the options of the store for the client (see WithClaims), and the upload belongs to the
+// subject of their claims.
+func (s *TusStore) Create(w http.ResponseWriter, r *http.Request, opts UploadOptions) {
+	s.expire()
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		tusError(w, fmt.Errorf("%w: invalid Upload-Length", ErrInvalidUpload))
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		tusError(w, fmt.Errorf("%w: %v", ErrInvalidUpload, err))
+		return
+	}
+
+	firstChunk := FirstChunk{
+		MimeType: metadata["filetype"],
+		MediaId:  metadata["mediaId"],
+		Size:     length,
+	}
+	if mimeType, ok := metadata["mimeType"]; ok {
+		firstChunk.MimeType = mimeType
+	}
+
+	info, err := describeUpload(firstChunk, opts)
+	if err != nil {
+		tusError(w, err)
+		return
+	}
+
+	// The session outlives the requests, which pass their contexts to it (see withContext).
+	upload := &tusUpload{
+		session:    newUploadSession(context.Background(), info, opts),
+		length:     length,
+		lastActive: time.Now(),
+		owner:      subjectOf(opts.Claims),
+	}
+
+	s.mu.Lock()
+	if _, ok := s.uploads[info.mediaId]; ok {
+		s.mu.Unlock()
+		tusError(w, fmt.Errorf("%w: upload already exists", ErrInvalidUpload))
+		return
+	}
+	s.uploads[info.mediaId] = upload
+	s.mu.Unlock()
+
+	// An empty upload is complete right away.
+	if length == 0 {
+		restore := upload.session.withContext(r.Context())
+		err := s.complete(info.mediaId, upload)
+		restore()
+		if err != nil {
+			tusError(w, err)
+			return
+		}
+	}
+
+	core.LogInfo(fmt.Sprintf("Created tus upload: %s", info.mediaId))
+
+	w.Header().Set("Location", s.BasePath+info.mediaId)
+	w.Header().Set("Upload-Offset", "0")
+	w.Header().Set("X-Media-Id", info.mediaId)
+	if upload.location != "" {
+		w.Header().Set("X-Media-Location", upload.location)
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Head returns the offset of an upload.
+func (s *TusStore) Head(w http.ResponseWriter, r *http.Request, id string, claims *auth.Claims) {
+	upload := s.lookup(id, claims)
+	if upload == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !upload.mu.TryLock() {
+		w.WriteHeader(http.StatusLocked)
+		return
+	}
+	defer upload.mu.Unlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.session.Size(), 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.length, 10))
+	if upload.location != "" {
+		w.Header().Set("X-Media-Location", upload.location)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Terminate aborts an upload and discards its data (termination extension).
+func (s *TusStore) Terminate(w http.ResponseWriter, r *http.Request, id string, claims *auth.Claims) {
+	upload := s.lookup(id, claims)
+	if upload == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !upload.mu.TryLock() {
+		w.WriteHeader(http.StatusLocked)
+		return
+	}
+	defer upload.mu.Unlock()
+
+	s.remove(id)
+	if upload.location == "" {
+		upload.session.Delete()
+	}
+
+	core.LogInfo(fmt.Sprintf("Terminated tus upload: %s", id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lookup returns the upload with the given id, nil if it doesn't exist or belongs to another client.
+func (s *TusStore) lookup(id string, claims *auth.Claims) *tusUpload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, ok := s.uploads[id]
+	if !ok || upload.owner != subjectOf(claims) {
+		return nil
+	}
+	upload.lastActive = time.Now()
+	return upload
+}
+
+// remove removes an upload from the store.
+func (s *TusStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.uploads, id)
+}
+
+// expire aborts the uploads that have been idle for longer than the expiration.
+func (s *TusStore) expire() {
+	if s.Expiration <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	expired := make(map[string]*tusUpload)
+	for id, upload := range s.uploads {
+		if time.Since(upload.lastActive) > s.Expiration {
+			expired[id] = upload
+			delete(s.uploads, id)
+		}
+	}
+	s.mu.Unlock()
+
+	for id, upload := range expired {
+		if !upload.mu.TryLock() {
+			// A request is still in progress, the upload is dropped from the store anyway.
+			continue
+		}
+		if upload.location == "" {
+			upload.session.Abort()
+		}
+		upload.mu.Unlock()
+		core.LogInfo(fmt.Sprintf("Expired tus upload: %s", id))
+	}
+}
+
+// Shutdown aborts the uploads that haven't been completed, since they can't be resumed after a restart.
+// The uploads with a request in progress are left to the request.
+func (s *TusStore) Shutdown() {
+	s.mu.Lock()
+	uploads := s.uploads
+	s.uploads = make(map[string]*tusUpload)
+	s.mu.Unlock()
+
+	for id, upload := range uploads {
+		if !upload.mu.TryLock() {
+			continue
+		}
+		if upload.location == "" {
+			upload.session.Abort()
+			core.LogInfo(fmt.Sprintf("Aborted tus upload: %s", id))
+		}
+		upload.mu.Unlock()
+	}
+}
+
+// complete completes the upload of the session. The caller must hold the mutex of the upload.
+func (s *TusStore) complete(id string, upload *tusUpload) error {
+	loc, err := upload.session.Complete()
+	if err != nil {
+		core.LogError("Error (while completing tus upload)", err)
+		upload.session.Abort()
+		s.remove(id)
+		return err
+	}
+
+	upload.location = loc
+	core.LogInfo(fmt.Sprintf("Video uploaded successfully. Location: %s", loc))
+	return nil
+}
+
+// TusPatchTask represents a task for a PATCH request of the tus protocol, which appends data to an upload.
+type TusPatchTask struct {
+	task    core.Task
+	Store   *TusStore
+	Id      string
+	Writer  http.ResponseWriter
+	Request *http.Request
+	// Claims are the verified claims of the client, nil if authentication is disabled.
+	Claims *auth.Claims
+
+	// Done is closed when the response has been written.
+	Done chan struct{}
+}
+
+// Execute method implements the task execution logic for tus PATCH requests.
+func (t *TusPatchTask) Execute() error {
+	return t.ExecuteContext(context.Background())
+}
+
+// ExecuteContext executes the PATCH request with a context. When the context is done, the request body
+// is no longer read and the upload is dropped.
+func (t *TusPatchTask) ExecuteContext(ctx context.Context) error {
+	defer close(t.Done)
+
+	stop := context.AfterFunc(ctx, func() { interruptRead(t.Writer) })
+	defer stop()
+
+	w, r := t.Writer, t.Request
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return nil
+	}
+
+	upload := t.Store.lookup(t.Id, t.Claims)
+	if upload == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	if !upload.mu.TryLock() {
+		w.WriteHeader(http.StatusLocked)
+		return nil
+	}
+	defer upload.mu.Unlock()
+
+	// The storage calls of the request end with the task.
+	defer upload.session.withContext(ctx)()
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != upload.session.Size() || upload.location != "" {
+		w.WriteHeader(http.StatusConflict)
+		return nil
+	}
+
+	err = t.append(upload)
+	if err == nil && upload.session.Size() == upload.length {
+		err = t.Store.complete(t.Id, upload)
+	}
+
+	if err != nil {
+		if _, ok := statusFor(err); (!ok || !upload.session.resumable()) && err != errChecksumMismatch {
+			// The state of the session is unknown after an internal error, and data that has been taken
+			// before a rejection can't be taken back, so the upload is dropped.
+			upload.session.Abort()
+			t.Store.remove(t.Id)
+		}
+		tusError(w, err)
+		return err
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.session.Size(), 10))
+	if upload.location != "" {
+		w.Header().Set("X-Media-Location", upload.location)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// Reject writes the response of a task that has not been accepted by the worker pool.
+func (t *TusPatchTask) Reject(err error) {
+	defer close(t.Done)
+	tusError(t.Writer, err)
+}
+
+// errChecksumMismatch is returned when the checksum of a PATCH request doesn't match its body.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// append writes the body of the request to the upload session. Without a checksum, the body is streamed
+// and everything received counts, even if the request is interrupted. With a checksum, the body is spooled
+// to a temporary file and discarded unless the checksum matches.
+func (t *TusPatchTask) append(upload *tusUpload) error {
+	remaining := upload.length - upload.session.Size()
+	// One more byte than allowed is read, so that too large bodies are detected.
+	body := io.LimitReader(t.Request.Body, remaining+1)
+
+	checksum := t.Request.Header.Get("Upload-Checksum")
+	if checksum == "" {
+		return copyToSession(upload.session, body)
+	}
+
+	h, expected, err := parseTusChecksum(checksum)
+	if err != nil {
+		return err
+	}
+
+	spool, err := os.CreateTemp("", "tus-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	if _, err := io.Copy(io.MultiWriter(spool, h), body); err != nil {
+		return err
+	}
+
+	if string(h.Sum(nil)) != string(expected) {
+		return errChecksumMismatch
+	}
+
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return copyToSession(upload.session, spool)
+}
+
+// copyToSession writes everything from the reader to the upload session.
+func copyToSession(session *uploadSession, reader io.Reader) error {
+	buf := make([]byte, formReadSize)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			if err := session.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// subjectOf returns the subject of the claims, empty if authentication is disabled.
+func subjectOf(claims *auth.Claims) string {
+	if claims == nil {
+		return ""
+	}
+	return claims.Subject
+}
+
+// parseTusChecksum parses the Upload-Checksum header ("<algorithm> <base64 checksum>").
+func parseTusChecksum(value string) (hash.Hash, []byte, error) {
+	algorithm, encoded, ok := strings.Cut(value, " ")
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: invalid Upload-Checksum", ErrInvalidUpload)
+	}
+
+	checksum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: invalid Upload-Checksum", ErrInvalidUpload)
+	}
+
+	switch algorithm {
+	case "sha1":
+		return sha1.New(), checksum, nil
+	case "md5":
+		return md5.New(), checksum, nil
+	case "sha256":
+		return sha256.New(), checksum, nil
+	}
+	return nil, nil, fmt.Errorf("%w: unsupported checksum algorithm: %s", ErrInvalidUpload, algorithm)
+}
+
+// parseTusMetadata parses the Upload-Metadata header ("key base64value,key2 base64value2").
+func parseTusMetadata(value string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if value == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("invalid Upload-Metadata")
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value of %s", key)
+		}
+		metadata[key] = string(decoded)
+	}
+
+	return metadata, nil
+}
+
+// tusError writes the error response of a tus request. Internal errors are not exposed.
+func tusError(w http.ResponseWriter, err error) {
+	msg := errorMessage(0, err)
+
+	status, ok := statusFor(err)
+	switch {
+	case err == errChecksumMismatch:
+		status = tusStatusChecksumMismatch
+		msg.Error = err.Error()
+	case !ok:
+		status = http.StatusInternalServerError
+	default:
+		core.LogWarning(fmt.Sprintf("Upload rejected: %v", err))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(msg)
+}
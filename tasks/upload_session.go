@@ -0,0 +1,569 @@
+package tasks
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"mime"
+	"os"
+	"regexp"
+
+	"github.com/media_uploader/audit"
+	"github.com/media_uploader/core"
+	"github.com/media_uploader/quota"
+	"github.com/media_uploader/storage"
+)
+
+// partSize is the size of every non-trailing part of a multipart upload.
+//
+// NOTE: Amazon S3 mandates a minimum part size of 5 MB for multipart uploads.
+// Our approach is to upload in 5 MB parts if the buffer size exceeds this threshold.
+// Otherwise, we upload the data in a single part.
+// However, this strategy imposes a 50 GB upper limit (5 * 10000 MiB) on the data size
+// due to the minimum part size.
+// In a scenario where 200 users upload <5 MB data (e.g., 3 MB each) and 800 users upload >5 MB data (e.g., 250 MB each),
+// the calculated RAM usage for 1000 connections is as follows:
+// (3 * 100) MB + (800 * 5) MB = ~4.3 GB.
+// It's important to note that Goroutines have different lifetimes, and during processing,
+// some reserved memory will be released by the Go garbage collector,
+// especially when handling smaller uploads like the <5MB MB example.
+// R2 does not supported the different non-trailing part sizes for multipart uploads like AWS S3.
+// So we have to be sure that every part is exactly 5 MB.
+const partSize = 5 * 1024 * 1024
+
+// uploadSession ships the data of a single media file to the storage.
+// Small files are uploaded directly, larger ones are switched to a multipart upload
+// as soon as the first full part has been buffered.
+//
+// The content type is verified against the leading bytes of the data before anything is stored.
+type uploadSession struct {
+	// ctx is the context of the storage calls and the rate limit waits, see withContext.
+	ctx context.Context
+	// base is the context of the session, which the malware scan of the streamed bytes is bound to.
+	base context.Context
+	info uploadInfo
+	opts UploadOptions
+	// sniffed is set once the content type has been verified.
+	sniffed bool
+
+	// tempFile keeps a local copy of the upload if temporary saving is enabled.
+	tempFile *os.File
+	tempPath string
+
+	buffer     []byte
+	multipart  storage.MultipartUpload
+	partNumber int32
+	size       int64
+	// checksum is the SHA-256 hash of the received data.
+	checksum hash.Hash
+	// reservation is the quota of the tenant taken by the received data.
+	reservation *quota.Reservation
+	// scan is the malware scan of the streamed bytes, nil until the first data arrives.
+	scan *streamScan
+	// ended is set once the end of the upload has been recorded in the audit log.
+	ended bool
+	// broken is set when a write fails after its data has been taken, so the upload can't be continued.
+	broken bool
+}
+
+// extensionPattern matches the file extensions that are safe to use in file paths and object keys.
+var extensionPattern = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+
+// ErrInvalidUpload is returned when the first chunk doesn't describe a valid upload.
+var ErrInvalidUpload = errors.New("invalid upload")
+
+// uploadInfo describes an upload that has been accepted at handshake time.
+type uploadInfo struct {
+	// mediaType is the media type without parameters (e.g. "video/webm").
+	mediaType string
+	// params are the parameters of the MIME type (e.g. codecs).
+	params  map[string]string
+	mediaId string
+	// size is the declared size of the upload in bytes, zero if unknown.
+	size int64
+	// maxSize is the maximum number of bytes accepted for the upload, zero for unlimited.
+	maxSize int64
+	// sizeCap is a maximum size that applies on top of the limits (e.g. of fetched files), zero for none.
+	sizeCap int64
+	// policies are the upload policies that apply to the upload.
+	policies []Policy
+}
+
+// contentType returns the MIME type with its parameters.
+func (i uploadInfo) contentType() string {
+	return mime.FormatMediaType(i.mediaType, i.params)
+}
+
+// extension returns the file extension of the upload.
+func (i uploadInfo) extension() string {
+	extension := extensionFor(i.mediaType)
+	if !extensionPattern.MatchString(extension) {
+		return "bin"
+	}
+	return extension
+}
+
+// fileName returns the name of the uploaded file.
+func (i uploadInfo) fileName() string {
+	return i.mediaId + "." + i.extension()
+}
+
+// admitType checks the media type of the upload against its policies.
+func (i uploadInfo) admitType() error {
+	for _, policy := range i.policies {
+		if rejection := policy.admitType(i.mediaType, i.extension()); rejection != nil {
+			return rejection
+		}
+	}
+	return nil
+}
+
+// admitSize checks the final size of the upload against its policies.
+func (i uploadInfo) admitSize(size int64) error {
+	for _, policy := range i.policies {
+		if rejection := policy.admitSize(size); rejection != nil {
+			return rejection
+		}
+	}
+	return nil
+}
+
+// limitSize sets the maximum size of the upload from the size limit of its media type and
+// the strictest maximum size of its policies.
+// An error is returned if the declared size already exceeds the limit.
+func (i *uploadInfo) limitSize(limits SizeLimits) error {
+	maxSize, err := limits.maxUploadSize(FirstChunk{MimeType: i.mediaType, Size: i.size})
+	if err != nil {
+		return err
+	}
+
+	// The strictest maximum size of the policies applies as well.
+	for _, policy := range i.policies {
+		if policy.MaxSize > 0 && (maxSize == 0 || policy.MaxSize < maxSize) {
+			maxSize = policy.MaxSize
+		}
+	}
+	if i.sizeCap > 0 && (maxSize == 0 || i.sizeCap < maxSize) {
+		maxSize = i.sizeCap
+	}
+
+	i.maxSize = maxSize
+	return nil
+}
+
+// describeUpload validates the first chunk and describes the upload.
+// The media id is generated by the server unless client-supplied ids are allowed.
+// The upload has to be admitted by the upload policies of its endpoint and tenant.
+func describeUpload(firstChunk FirstChunk, opts UploadOptions) (uploadInfo, error) {
+	mediaType, params, err := parseMimeType(firstChunk.MimeType)
+	if err != nil {
+		return uploadInfo{}, fmt.Errorf("%w: %v", ErrInvalidUpload, err)
+	}
+
+	info := uploadInfo{
+		mediaType: mediaType,
+		params:    params,
+		size:      firstChunk.Size,
+		policies:  opts.Policies.policiesFor(opts.Endpoint, opts.Tenant),
+	}
+
+	// The restrictions of a ticket or an API key are enforced like a policy.
+	if opts.Ticket != nil {
+		info.policies = append(info.policies, Policy{AllowedTypes: opts.Ticket.AllowedTypes, MaxSize: opts.Ticket.MaxSize})
+	}
+	if key := opts.apiKey(); key != nil {
+		info.policies = append(info.policies, Policy{MaxSize: key.MaxSize})
+	}
+
+	if err := info.admitType(); err != nil {
+		return uploadInfo{}, err
+	}
+
+	for _, policy := range info.policies {
+		if rejection := policy.admitDeclaredSize(firstChunk.Size); rejection != nil {
+			return uploadInfo{}, rejection
+		}
+	}
+
+	mediaId, err := resolveMediaId(firstChunk.MediaId, opts.AllowClientMediaId)
+	if opts.Ticket != nil {
+		mediaId, err = resolveTicketMediaId(firstChunk.MediaId, opts.Ticket, opts.AllowClientMediaId)
+	} else if key := opts.apiKey(); key != nil && key.Prefix != "" {
+		mediaId, err = resolvePrefixedMediaId(firstChunk.MediaId, key.Prefix, opts.AllowClientMediaId)
+	}
+	if err != nil {
+		return uploadInfo{}, fmt.Errorf("%w: %v", ErrInvalidUpload, err)
+	}
+
+	if err := info.limitSize(opts.Limits); err != nil {
+		return uploadInfo{}, err
+	}
+
+	if err := opts.Quotas.Check(opts.Tenant, firstChunk.Size); err != nil {
+		return uploadInfo{}, quotaRejection(err)
+	}
+
+	info.mediaId = mediaId
+	return info, nil
+}
+
+// newUploadSession creates an upload session for the given file.
+func newUploadSession(ctx context.Context, info uploadInfo, opts UploadOptions) *uploadSession {
+	s := &uploadSession{
+		ctx:        ctx,
+		base:       ctx,
+		info:       info,
+		opts:       opts,
+		partNumber: 1,
+		checksum:   sha256.New(),
+	}
+	s.record(audit.UploadStarted, "")
+	return s
+}
+
+// record writes an event of the upload to the audit log. The checksum is recorded with the completion only.
+func (s *uploadSession) record(event, location string) {
+	if s.opts.Audit == nil {
+		return
+	}
+
+	e := audit.Event{
+		Event:       event,
+		MediaId:     s.info.mediaId,
+		ObjectKey:   s.info.fileName(),
+		Endpoint:    s.opts.Endpoint,
+		Subject:     s.opts.subject(),
+		Tenant:      s.opts.Tenant,
+		ClientIP:    s.opts.ClientIP,
+		ContentType: s.info.contentType(),
+		Size:        s.size,
+		Location:    location,
+	}
+	if event == audit.UploadCompleted {
+		e.Checksum = s.Checksum()
+	}
+	s.opts.Audit.Record(e)
+}
+
+// withContext replaces the context of the storage calls and the rate limit waits until the returned function
+// is called. It's meant for uploads that span several requests, whose calls end with the current request.
+func (s *uploadSession) withContext(ctx context.Context) (restore func()) {
+	s.ctx = ctx
+	return func() { s.ctx = s.base }
+}
+
+// ensureTempDir creates a 'temp' folder if it does not exist.
+func ensureTempDir() {
+	_, err := os.Stat("temp")
+	if os.IsNotExist(err) {
+		errDir := os.Mkdir("temp", 0755)
+		if errDir != nil {
+			fmt.Println("Error:", errDir, "not critical. It keeps going.")
+		}
+	}
+}
+
+// backend returns the storage of the uploaded files.
+func (s *uploadSession) backend() storage.Storage {
+	if s.opts.Storage == nil {
+		return storage.S3Storage{}
+	}
+	return s.opts.Storage
+}
+
+// Size returns the number of bytes received so far.
+func (s *uploadSession) Size() int64 {
+	return s.size
+}
+
+// Checksum returns the hex encoded SHA-256 hash of the data received so far.
+func (s *uploadSession) Checksum() string {
+	return hex.EncodeToString(s.checksum.Sum(nil))
+}
+
+// Write appends the received data to the session and uploads every full part.
+// ErrTooLarge is returned if the data exceeds the maximum size of the upload, and
+// ErrTypeMismatch if the content is rejected by the type policy.
+// The session is broken if the data has been appended before the error, see resumable.
+func (s *uploadSession) Write(message []byte) error {
+	// Waiting for the rate limit slows the client down through the flow control of the connection.
+	if err := s.opts.ByteRate.Wait(s.ctx, s.opts.ClientKey, len(message)); err != nil {
+		return err
+	}
+
+	if s.info.maxSize > 0 && s.size+int64(len(message)) > s.info.maxSize {
+		return fmt.Errorf("%w: more than %d bytes received", ErrTooLarge, s.info.maxSize)
+	}
+
+	if err := s.reserve(int64(len(message))); err != nil {
+		return err
+	}
+
+	s.buffer = append(s.buffer, message...)
+	s.size += int64(len(message))
+	s.checksum.Write(message)
+
+	if err := s.process(message); err != nil {
+		s.broken = true
+		return err
+	}
+	return nil
+}
+
+// resumable reports whether more data can be written after a failed write.
+func (s *uploadSession) resumable() bool {
+	return !s.broken
+}
+
+// process scans, verifies and uploads the data that has been appended by Write.
+func (s *uploadSession) process(message []byte) error {
+	if err := s.scanData(message); err != nil {
+		return err
+	}
+
+	if !s.sniffed {
+		// Wait for enough data to detect the content type.
+		if len(s.buffer) < sniffLen {
+			return nil
+		}
+		if err := s.verifyType(); err != nil {
+			return err
+		}
+	} else if s.tempFile != nil {
+		// Write the received data to the binary file.
+		_, err := s.tempFile.Write(message)
+		if err != nil {
+			core.LogError("Error (while writing to binary file)", err)
+			return err
+		}
+	}
+
+	for len(s.buffer) >= partSize {
+		if s.multipart == nil {
+			multipart, err := s.backend().StartMultipart(s.ctx, s.info.contentType(), s.info.fileName())
+			if err != nil {
+				core.LogError("Error (while initializing multipart upload)", err)
+				return err
+			}
+			s.multipart = multipart
+		}
+
+		part := s.buffer[:partSize]
+		// remove the uploaded part from buffer for the next one
+		s.buffer = s.buffer[partSize:]
+		if err := s.multipart.UploadPart(s.ctx, s.partNumber, part); err != nil {
+			core.LogError("Error (while uploading part)", err)
+			return err
+		}
+
+		s.partNumber += 1
+	}
+
+	return nil
+}
+
+// reserve takes n more bytes of the quota of the tenant. The object is reserved with the first call.
+func (s *uploadSession) reserve(n int64) error {
+	if s.reservation == nil {
+		reservation, err := s.opts.Quotas.Reserve(s.opts.Tenant)
+		if err != nil {
+			return quotaRejection(err)
+		}
+		s.reservation = reservation
+	}
+	return quotaRejection(s.reservation.Grow(n))
+}
+
+// verifyType detects the content type from the buffered data and applies the type policy.
+// The temporary file is created afterwards, since the verified type decides the file extension.
+func (s *uploadSession) verifyType() error {
+	s.sniffed = true
+
+	detected := sniffContentType(s.buffer)
+	if detected != "" && !compatibleTypes(s.info.mediaType, detected) {
+		switch s.opts.TypePolicy {
+		case TypePolicyReject:
+			return fmt.Errorf("%w: %s declared, %s detected", ErrTypeMismatch, s.info.mediaType, detected)
+		case TypePolicyCorrect:
+			core.LogWarning(fmt.Sprintf("Content type corrected from %s to %s: %s", s.info.mediaType, detected, s.info.mediaId))
+			s.info.mediaType = detected
+			s.info.params = nil
+
+			// The corrected type has to be admitted as well.
+			if err := s.info.admitType(); err != nil {
+				return err
+			}
+
+			// So does the size limit of the corrected type, which the received data may already exceed.
+			if err := s.info.limitSize(s.opts.Limits); err != nil {
+				return err
+			}
+			if s.info.maxSize > 0 && s.size > s.info.maxSize {
+				return fmt.Errorf("%w: more than %d bytes received", ErrTooLarge, s.info.maxSize)
+			}
+		}
+	}
+
+	// Create a binary file to store the uploaded data.
+	if s.opts.SaveUploadsTemporarily {
+		ensureTempDir()
+
+		binaryFile, err := os.OpenFile("temp/"+s.info.fileName(), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			core.LogError("Error (while creating binary file)", err)
+			return err
+		}
+		s.tempFile = binaryFile
+		s.tempPath = binaryFile.Name()
+
+		_, err = s.tempFile.Write(s.buffer)
+		if err != nil {
+			core.LogError("Error (while writing to binary file)", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Complete uploads the remaining data and returns the location of the uploaded file.
+// The upload is recorded in the usage of the tenant.
+func (s *uploadSession) Complete() (string, error) {
+	// Empty uploads take an object of the quota as well.
+	if err := s.reserve(0); err != nil {
+		return "", err
+	}
+
+	loc, err := s.complete()
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.reservation.Commit(); err != nil {
+		core.LogError("Error (while recording usage)", err)
+	}
+	s.reservation = nil
+
+	s.ended = true
+	s.record(audit.UploadCompleted, loc)
+	return loc, nil
+}
+
+// complete stores the upload.
+func (s *uploadSession) complete() (string, error) {
+	if !s.sniffed {
+		if err := s.verifyType(); err != nil {
+			return "", err
+		}
+	}
+	s.closeTempFile()
+
+	if err := s.info.admitSize(s.size); err != nil {
+		return "", err
+	}
+
+	// Nothing is stored before the upload has been scanned.
+	if err := s.verdict(); err != nil {
+		return "", err
+	}
+
+	if s.multipart == nil {
+		loc, err := s.backend().DirectUpload(s.ctx, s.info.contentType(), s.info.fileName(), s.buffer)
+		if err != nil {
+			return "", err
+		}
+		s.buffer = nil
+		return loc, nil
+	}
+
+	// The trailing part may be smaller than the part size.
+	if len(s.buffer) > 0 {
+		if err := s.multipart.UploadPart(s.ctx, s.partNumber, s.buffer); err != nil {
+			core.LogError("Error (while uploading part)", err)
+			return "", err
+		}
+		s.buffer = nil
+	}
+
+	loc, err := s.multipart.Complete(s.ctx)
+	if err != nil {
+		return "", err
+	}
+	if loc == "" {
+		return "", errors.New("failed to upload video")
+	}
+
+	return loc, nil
+}
+
+// Abort discards the upload. The multipart upload is aborted on the storage, and the
+// temporary file is removed if it's too small to be useful.
+func (s *uploadSession) Abort() {
+	s.discard(audit.UploadAborted, false)
+}
+
+// Cancel discards the upload on behalf of the client. Unlike Abort, the temporary file
+// is always removed.
+func (s *uploadSession) Cancel() {
+	s.discard(audit.UploadCancelled, true)
+}
+
+// Delete discards the upload when the client deletes it, like Cancel.
+func (s *uploadSession) Delete() {
+	s.discard(audit.UploadDeleted, true)
+}
+
+// discard aborts the multipart upload, cleans up the temporary file and records the event of the end
+// of the upload, unless an end has been recorded before.
+func (s *uploadSession) discard(event string, removeTempFile bool) {
+	if !s.ended {
+		s.ended = true
+		s.record(event, "")
+	}
+
+	s.buffer = nil
+	s.reservation.Release()
+	s.reservation = nil
+
+	if s.scan != nil {
+		s.scan.cancel()
+		s.scan = nil
+	}
+
+	if s.multipart != nil {
+		// The upload may be discarded because its context is done, the parts have to be aborted anyway.
+		s.multipart.Abort(context.WithoutCancel(s.ctx))
+		s.multipart = nil
+	}
+
+	if s.tempPath == "" {
+		return
+	}
+	s.closeTempFile()
+
+	if removeTempFile {
+		os.Remove(s.tempPath)
+		return
+	}
+
+	// Check file size <1kb, remove incomplete file if true.
+	stat, err := os.Stat(s.tempPath)
+	if err != nil {
+		core.LogError("Error (while checking file size)", err)
+		return
+	}
+	if stat.Size() < 1024 {
+		os.Remove(s.tempPath)
+	}
+}
+
+// closeTempFile closes the temporary file once.
+func (s *uploadSession) closeTempFile() {
+	if s.tempFile != nil {
+		s.tempFile.Close()
+		s.tempFile = nil
+	}
+}